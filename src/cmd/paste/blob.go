@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// The text of each revision is stored once, named by its SHA-256, however many revisions (of however many pastes)
+// share it:
+//
+//     blobs.sha256/9f/86/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//
+// The "." means the dir can never clash with a paste Id. Revisions from before blobs existed have no Hash and are
+// still read from their own file.
+const blobDirName = "blobs.sha256"
+
+// Each blob is reference counted here by its hash, counting every revision which uses it and every pending write
+// which is about to. A blob's file is only removed once its count reaches zero.
+var blobBucketNameStr = "blob"
+var blobBucketName = []byte(blobBucketNameStr)
+
+// The blobs of public pastes are also indexed here, keyed by "<hash> <id>", so that /hash/:hash only answers for text
+// which anyone could already have read. The index is kept by putRevision and delRevisions.
+var publicBlobBucketNameStr = "publicblob"
+var publicBlobBucketName = []byte(publicBlobBucketNameStr)
+
+// hashText returns the hex SHA-256 of the text, which is what its blob is called.
+func hashText(text []byte) string {
+	sum := sha256.Sum256(text)
+	return hex.EncodeToString(sum[:])
+}
+
+// isHash says whether str looks like a hash from hashText.
+func isHash(str string) bool {
+	if len(str) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range str {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// blobFilename returns where the blob with this hash lives, sharded like paste files.
+func blobFilename(dir, hash string) string {
+	return dir + "/" + blobDirName + "/" + pasteShard(hash) + "/" + hash
+}
+
+// openRevisionFile opens the file with the text of this revision, either its blob or (from before blobs) its own file.
+// It is returned as it is stored, with true if it is gzipped.
+func openRevisionFile(dir, id string, revision Revision) (*os.File, bool, error) {
+	if revision.Hash == "" {
+		f, err := openPasteFile(dir, id, revision.Rev)
+		return f, false, err
+	}
+
+	filename := blobFilename(dir, revision.Hash)
+	f, err := os.Open(filename + gzipExt)
+	if !os.IsNotExist(err) {
+		return f, true, err
+	}
+	f, err = os.Open(filename)
+	if !os.IsNotExist(err) {
+		return f, false, err
+	}
+	// it may have been compressed in between
+	f, err = os.Open(filename + gzipExt)
+	return f, true, err
+}
+
+// openRevisionText opens the text of this revision, decompressing it if need be.
+func openRevisionText(dir, id string, revision Revision) (io.ReadCloser, error) {
+	f, gzipped, err := openRevisionFile(dir, id, revision)
+	if err != nil {
+		return nil, err
+	}
+	if gzipped {
+		return &gzipFile{f: f}, nil
+	}
+	return f, nil
+}
+
+// blobRefs returns how many references there are to the blob.
+func blobRefs(tx *bolt.Tx, hash string) (int, error) {
+	str, err := rod.GetString(tx, blobBucketNameStr, hash)
+	if err != nil || str == "" {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+// refBlob adds one reference to the blob.
+func refBlob(tx *bolt.Tx, hash string) error {
+	refs, err := blobRefs(tx, hash)
+	if err != nil {
+		return err
+	}
+	return rod.PutString(tx, blobBucketNameStr, hash, strconv.Itoa(refs+1))
+}
+
+// unrefBlob removes one reference to the blob, returning true if that was the last one.
+func unrefBlob(tx *bolt.Tx, hash string) (bool, error) {
+	refs, err := blobRefs(tx, hash)
+	if err != nil {
+		return false, err
+	}
+	if refs <= 1 {
+		return true, rod.Del(tx, blobBucketNameStr, hash)
+	}
+	return false, rod.PutString(tx, blobBucketNameStr, hash, strconv.Itoa(refs-1))
+}
+
+// countBlobRefs recounts every blob reference from the revisions and pending writes, replacing whatever was there.
+// It returns the new counts.
+func countBlobRefs(tx *bolt.Tx) (map[string]int, error) {
+	refs := make(map[string]int)
+
+	b := tx.Bucket(pasteBucketName)
+	if b != nil {
+		err := b.ForEach(func(k, v []byte) error {
+			paste := Paste{}
+			err := json.Unmarshal(v, &paste)
+			if err != nil {
+				return err
+			}
+			revisions, err := getRevisions(tx, paste)
+			if err != nil {
+				return err
+			}
+			for _, revision := range revisions {
+				if revision.Hash != "" {
+					refs[revision.Hash]++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b = tx.Bucket(pendingBucketName)
+	if b != nil {
+		err := b.ForEach(func(k, v []byte) error {
+			p := pendingWrite{}
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+			if p.Hash != "" {
+				refs[p.Hash]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tx.Bucket(blobBucketName) != nil {
+		err := tx.DeleteBucket(blobBucketName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for hash, n := range refs {
+		err := rod.PutString(tx, blobBucketNameStr, hash, strconv.Itoa(n))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func publicBlobKey(hash, id string) string {
+	return hash + " " + id
+}
+
+// isPublicBlob says whether any public paste has a revision with this blob.
+func isPublicBlob(tx *bolt.Tx, hash string) bool {
+	b := tx.Bucket(publicBlobBucketName)
+	if b == nil {
+		return false
+	}
+	prefix := []byte(hash + " ")
+	k, _ := b.Cursor().Seek(prefix)
+	return k != nil && bytes.HasPrefix(k, prefix)
+}
+
+// indexPublicBlobs rebuilds the public blob index from the public bucket and the revisions, replacing whatever was
+// there.
+func indexPublicBlobs(tx *bolt.Tx) error {
+	if tx.Bucket(publicBlobBucketName) != nil {
+		err := tx.DeleteBucket(publicBlobBucketName)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.CreateBucket(publicBlobBucketName)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket(publicBucketName)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, string(k), &paste)
+		if err != nil || paste.Id == "" {
+			return err
+		}
+		revisions, err := getRevisions(tx, paste)
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			if revision.Hash == "" {
+				continue
+			}
+			err := rod.Put(tx, publicBlobBucketNameStr, publicBlobKey(revision.Hash, paste.Id), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeBlob makes sure the blob for this text is on disk (or in object storage), gzipped. The blob must already be
+// referenced (by a pending write) so that it can't be removed once it's there.
+func (s *BoltStore) writeBlob(hash string, text []byte) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	filename := blobFilename(s.dir, hash)
+	if fileExists(filename+gzipExt) || fileExists(filename) {
+		// already stored by another revision
+		return nil
+	}
+	gz, err := gzipText(text)
+	if err != nil {
+		return err
+	}
+	if s.objects != nil {
+		_, err := s.putObject(hash, gz)
+		return err
+	}
+	return writeFileAtomic(filename+gzipExt, gz)
+}
+
+// removeBlob removes the blob's file (and object), as long as nothing has referenced it again since its last reference
+// went. If a dump is running it is only removed once the dump has finished.
+func (s *BoltStore) removeBlob(hash string) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	return s.afterDumps(func() error {
+		return s.removeUnusedBlob(hash)
+	})
+}
+
+// removeUnusedBlob does the work of removeBlob, with blobMu held.
+func (s *BoltStore) removeUnusedBlob(hash string) error {
+	refs := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		refs, err = blobRefs(tx, hash)
+		return err
+	})
+	if err != nil || refs > 0 {
+		return err
+	}
+
+	filename := blobFilename(s.dir, hash)
+	for _, f := range []string{filename + ".tmp", filename, filename + gzipExt + ".tmp", filename + gzipExt} {
+		err := removeFile(f)
+		if err != nil {
+			return err
+		}
+	}
+	if s.objects != nil {
+		return s.objects.Delete(s.objects.blobKey(hash))
+	}
+	return nil
+}
+
+// startDump stops anything being removed from dir (or object storage) until endDump, since a dump reads the files of
+// the snapshot it started with and they may have been deleted since.
+func (s *BoltStore) startDump() {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	s.dumps++
+}
+
+// endDump finishes what startDump began. The last dump to finish does every removal which was queued whilst they ran.
+func (s *BoltStore) endDump() {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	s.dumps--
+	if s.dumps > 0 {
+		return
+	}
+	for _, remove := range s.removals {
+		err := remove()
+		if err != nil {
+			log.Printf("Error removing a file after the dump: %s\n", err)
+		}
+	}
+	s.removals = nil
+}
+
+// afterDumps calls remove now, or if a dump is running queues it for endDump. blobMu must be held, and is held when
+// remove is called.
+func (s *BoltStore) afterDumps(remove func() error) error {
+	if s.dumps > 0 {
+		s.removals = append(s.removals, remove)
+		return nil
+	}
+	return remove()
+}
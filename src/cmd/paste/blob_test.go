@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBlobRefs(t *testing.T) {
+	store, _ := newBoltStore(t)
+	same, other := hashText([]byte("same")), hashText([]byte("other"))
+
+	check := func(when string, hash string, want int) {
+		t.Helper()
+		refs := 0
+		err := store.db.View(func(tx *bolt.Tx) error {
+			var err error
+			refs, err = blobRefs(tx, hash)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs != want {
+			t.Errorf("after %s, blob %s has %d reference(s), want %d", when, hash[:8], refs, want)
+		}
+		if exists := fileExists(blobFilename(store.dir, hash) + gzipExt); exists != (want > 0) {
+			t.Errorf("after %s, blob %s exists: %t, want %t", when, hash[:8], exists, want > 0)
+		}
+	}
+
+	// the same text is only stored once, however many times it's used
+	a := createPaste(t, store, "same")
+	b := createPaste(t, store, "same")
+	check("creating two pastes with the same text", same, 2)
+
+	_, err := store.Revise(b.Id, "", []byte("other"))
+	if err != nil {
+		t.Fatalf("Revise() returned an error: %s", err)
+	}
+	check("revising one", same, 2)
+	check("revising one", other, 1)
+
+	_, err = store.Revise(a.Id, "", []byte("same"))
+	if err != nil {
+		t.Fatalf("Revise() returned an error: %s", err)
+	}
+	check("revising the other to the same text", same, 3)
+
+	// and it's only removed when nothing uses it any more
+	_, err = store.Delete(a.Id)
+	if err != nil {
+		t.Fatalf("Delete() returned an error: %s", err)
+	}
+	check("deleting one", same, 1)
+	check("deleting one", other, 1)
+
+	_, err = store.Delete(b.Id)
+	if err != nil {
+		t.Fatalf("Delete() returned an error: %s", err)
+	}
+	check("deleting both", same, 0)
+	check("deleting both", other, 0)
+}
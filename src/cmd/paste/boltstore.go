@@ -0,0 +1,955 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+var pasteBucketNameStr = "paste"
+var pasteBucketName = []byte(pasteBucketNameStr)
+var publicBucketNameStr = "public"
+var publicBucketName = []byte(publicBucketNameStr)
+
+// Each paste gets its own bucket inside this one, containing one Revision per key.
+var revisionBucketNameStr = "revision"
+var revisionBucketName = []byte(revisionBucketNameStr)
+
+// Views are only counted for pastes with a view limit.
+var viewsBucketNameStr = "views"
+var viewsBucketName = []byte(viewsBucketNameStr)
+
+// Each file being written is recorded here first and removed in the same transaction which commits it, so anything
+// left here after a crash is a half finished write.
+var pendingBucketNameStr = "pending"
+var pendingBucketName = []byte(pendingBucketNameStr)
+
+// Each deleted paste leaves a tombstone so that incremental dumps can record the delete. They are pruned once a full
+// dump no longer needs them.
+var tombstoneBucketNameStr = "tombstone"
+var tombstoneBucketName = []byte(tombstoneBucketNameStr)
+
+// BoltStore keeps the paste metadata in bolt and the text of each revision as a blob in dir (or, if inBolt, in bolt
+// too, or if there are objects, in object storage).
+type BoltStore struct {
+	db      *bolt.DB
+	dir     string
+	inBolt  bool       // keep new blobs in the text bucket rather than dir
+	objects *s3Client  // keep new blobs in object storage rather than dir, if set
+	mu      sync.Mutex // so that only one revision is made at a time
+	blobMu  sync.Mutex // so that a blob isn't removed whilst it's being written
+
+	// Whilst a dump is reading the files of its snapshot, nothing it may need is removed. Removals are queued instead
+	// and done by the last dump to finish. Both are guarded by blobMu.
+	dumps    int
+	removals []func() error
+}
+
+// Make sure BoltStore implements Store.
+var _ Store = &BoltStore{}
+
+// NewBoltStore returns a BoltStore, creating the main buckets if they don't already exist.
+func NewBoltStore(db *bolt.DB, dir string) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+
+		_, err = tx.CreateBucketIfNotExists(pasteBucketName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(pendingBucketName)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(blobBucketName)
+		if err != nil {
+			return err
+		}
+
+		// the public blob index is new, so build it from the pastes already here
+		if tx.Bucket(publicBlobBucketName) == nil {
+			err = indexPublicBlobs(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db, dir: dir}, nil
+}
+
+// Create saves the paste in three steps so that a crash (or error) part way through can always be cleaned up. First the
+// Id is reserved with a pending write (which also references the blob), then the blob is written if it isn't already
+// there, and finally the paste is committed in the same transaction which removes the pending write. Anything still
+// pending at startup is removed by Recover.
+//
+// If the blob is kept in bolt then there is no file to write, so everything happens in the one transaction.
+func (s *BoltStore) Create(paste Paste, text []byte, ids IdAllocator) (Paste, error) {
+	rev := paste.LatestRevision()
+	hash := hashText(text)
+
+	allocate := func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		pb := tx.Bucket(pendingBucketName)
+		id, err := ids.Allocate(func(id string) bool {
+			return isReserved(id) || b.Get([]byte(id)) != nil || pb.Get([]byte(pendingKey(id, rev))) != nil
+		})
+		paste.Id = id
+		return err
+	}
+
+	inBolt := s.textInBolt(paste)
+	var gz []byte
+	var err error
+	if inBolt {
+		gz, err = gzipText(text)
+		if err != nil {
+			return paste, err
+		}
+	} else {
+		// reserve the Id
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			err := allocate(tx)
+			if err != nil {
+				return err
+			}
+			return putPending(tx, paste.Id, rev, hash)
+		})
+		if err != nil {
+			return paste, err
+		}
+
+		// save the text, unless it's already there
+		err = s.writeBlob(hash, text)
+		if err != nil {
+			s.abandon(paste.Id, rev)
+			return paste, err
+		}
+	}
+
+	// and commit
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if inBolt {
+			err := allocate(tx)
+			if err != nil {
+				return err
+			}
+			err = refBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+			err = putText(tx, hash, gz)
+			if err != nil {
+				return err
+			}
+		}
+
+		// check if this is a public paste and add the name to the public bucket
+		if paste.Visibility == "public" {
+			err := rod.PutString(tx, publicBucketNameStr, paste.Id, paste.Created.Format("20060201-150405.000000000"))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := putRevision(tx, paste.Id, Revision{Rev: rev, Size: paste.Size, Created: paste.Created, Hash: hash})
+		if err != nil {
+			return err
+		}
+
+		err = rod.PutJson(tx, pasteBucketNameStr, paste.Id, paste)
+		if err != nil {
+			return err
+		}
+
+		// in case this Id (e.g. a slug) has been used before
+		err = rod.Del(tx, tombstoneBucketNameStr, paste.Id)
+		if err != nil {
+			return err
+		}
+
+		return rod.Del(tx, pendingBucketNameStr, pendingKey(paste.Id, rev))
+	})
+	if err != nil {
+		if !inBolt {
+			s.abandon(paste.Id, rev)
+		}
+		return paste, err
+	}
+
+	return paste, nil
+}
+
+// textInBolt says whether the text of this paste is kept in the text bucket. Burn after reading pastes always have
+// their text in dir (or object storage) instead, so that it never ends up in a dump of the DB.
+func (s *BoltStore) textInBolt(paste Paste) bool {
+	return s.inBolt && !paste.Burn
+}
+
+func (s *BoltStore) Get(id string) (Paste, error) {
+	paste := Paste{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+	})
+	if err != nil {
+		return paste, err
+	}
+	if paste.Id == "" {
+		return paste, ErrNotFound
+	}
+	return paste, nil
+}
+
+func (s *BoltStore) Open(id string, rev int) (io.ReadCloser, error) {
+	// a file may be moved into a blob (or into bolt, or object storage) in between reading the revision and opening
+	// it, so if it has gone have one more go
+	for i := 0; ; i++ {
+		var revision Revision
+		var gz []byte
+		err := s.db.View(func(tx *bolt.Tx) error {
+			paste := Paste{}
+			err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+			if err != nil {
+				return err
+			}
+			if paste.Id == "" {
+				return ErrNotFound
+			}
+			revisions, err := getRevisions(tx, paste)
+			if err != nil {
+				return err
+			}
+			for _, r := range revisions {
+				if r.Rev == rev {
+					revision = r
+				}
+			}
+			if revision.Hash != "" {
+				gz, err = getText(tx, revision.Hash)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if revision.Rev == 0 {
+			return nil, ErrNotFound
+		}
+		if gz != nil {
+			return newTextReader(gz), nil
+		}
+
+		text, err := openRevisionText(s.dir, id, revision)
+		if os.IsNotExist(err) && s.objects != nil && revision.Hash != "" {
+			text, err = s.openObject(revision.Hash)
+		}
+		if os.IsNotExist(err) && i == 0 {
+			continue
+		}
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return text, nil
+	}
+}
+
+func (s *BoltStore) Revisions(id string) ([]Revision, error) {
+	var revisions []Revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil {
+			return err
+		}
+		if paste.Id == "" {
+			return ErrNotFound
+		}
+		revisions, err = getRevisions(tx, paste)
+		return err
+	})
+	return revisions, err
+}
+
+// Revise saves the new revision in the same three steps as Create. Revisions are made one at a time so that two edits
+// can't both reserve the same revision number.
+func (s *BoltStore) Revise(id, title string, text []byte) (Paste, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rev := 0
+	hash := hashText(text)
+	var gz []byte
+	var err error
+	if s.inBolt {
+		gz, err = gzipText(text)
+		if err != nil {
+			return Paste{}, err
+		}
+	} else {
+		// reserve the next revision
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			paste := Paste{}
+			err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+			if err != nil {
+				return err
+			}
+			if paste.Id == "" {
+				return ErrNotFound
+			}
+
+			rev = paste.LatestRevision() + 1
+			return putPending(tx, id, rev, hash)
+		})
+		if err != nil {
+			return Paste{}, err
+		}
+
+		// write the new revision, unless the same text is already there
+		err = s.writeBlob(hash, text)
+		if err != nil {
+			s.abandon(id, rev)
+			return Paste{}, err
+		}
+	}
+
+	// and commit
+	paste := Paste{}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil {
+			return err
+		}
+		if paste.Id == "" {
+			// deleted in the meantime
+			return ErrNotFound
+		}
+
+		if s.inBolt {
+			rev = paste.LatestRevision() + 1
+			err := refBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+			err = putText(tx, hash, gz)
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now().UTC()
+		revision := Revision{
+			Rev:     rev,
+			Size:    len(text),
+			Created: now,
+			Hash:    hash,
+		}
+		err = putRevision(tx, id, revision)
+		if err != nil {
+			return err
+		}
+
+		paste.Title = title
+		paste.Size = revision.Size
+		paste.Revision = revision.Rev
+		paste.Updated = now
+		err = rod.PutJson(tx, pasteBucketNameStr, id, paste)
+		if err != nil {
+			return err
+		}
+
+		return rod.Del(tx, pendingBucketNameStr, pendingKey(id, rev))
+	})
+	if err != nil {
+		if !s.inBolt {
+			s.abandon(id, rev)
+		}
+		return paste, err
+	}
+
+	return paste, nil
+}
+
+func (s *BoltStore) View(id string) (bool, error) {
+	viewed := false
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil {
+			return err
+		}
+		if paste.Id == "" {
+			return nil
+		}
+
+		str, err := rod.GetString(tx, viewsBucketNameStr, id)
+		if err != nil {
+			return err
+		}
+		views := 0
+		if str != "" {
+			views, err = strconv.Atoi(str)
+			if err != nil {
+				return err
+			}
+		}
+		if paste.MaxViews > 0 && views >= paste.MaxViews {
+			return nil
+		}
+
+		viewed = true
+		return rod.PutString(tx, viewsBucketNameStr, id, strconv.Itoa(views+1))
+	})
+
+	return viewed, err
+}
+
+func (s *BoltStore) Delete(id string) (bool, error) {
+	deleted := false
+
+	unused := make([]string, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil {
+			return err
+		}
+		if paste.Id == "" {
+			// already gone
+			return nil
+		}
+
+		// each revision is one reference to its blob
+		revisions, err := getRevisions(tx, paste)
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			if revision.Hash == "" {
+				continue
+			}
+			last, err := unrefBlob(tx, revision.Hash)
+			if err != nil {
+				return err
+			}
+			if last {
+				err := delText(tx, revision.Hash)
+				if err != nil {
+					return err
+				}
+				unused = append(unused, revision.Hash)
+			}
+		}
+
+		err = rod.Del(tx, publicBucketNameStr, id)
+		if err != nil {
+			return err
+		}
+		err = rod.Del(tx, viewsBucketNameStr, id)
+		if err != nil {
+			return err
+		}
+		err = delRevisions(tx, id)
+		if err != nil {
+			return err
+		}
+		err = putTombstone(tx, id)
+		if err != nil {
+			return err
+		}
+		deleted = true
+		return rod.Del(tx, pasteBucketNameStr, id)
+	})
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	// now that the metadata has gone, remove the files (from before blobs) and any blobs nothing else uses. Whatever
+	// fails is left for fsck, but it shouldn't stop the rest being removed.
+	s.blobMu.Lock()
+	err = s.afterDumps(func() error {
+		return removePasteFiles(s.dir, id)
+	})
+	s.blobMu.Unlock()
+	for _, hash := range unused {
+		rerr := s.removeBlob(hash)
+		if err == nil {
+			err = rerr
+		}
+	}
+	return true, err
+}
+
+// Import saves the paste in the same three steps as Create, so an import which is interrupted is cleaned up by Recover.
+func (s *BoltStore) Import(paste Paste, revisions []Revision, texts [][]byte) error {
+	err := checkImport(paste, revisions, texts)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = hashText(text)
+	}
+
+	exists := func(tx *bolt.Tx) bool {
+		if tx.Bucket(pasteBucketName).Get([]byte(paste.Id)) != nil {
+			return true
+		}
+		pb := tx.Bucket(pendingBucketName)
+		for _, revision := range revisions {
+			if pb.Get([]byte(pendingKey(paste.Id, revision.Rev))) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	abandon := func() {
+		for _, revision := range revisions {
+			s.abandon(paste.Id, revision.Rev)
+		}
+	}
+
+	inBolt := s.textInBolt(paste)
+	var gzs [][]byte
+	if inBolt {
+		gzs = make([][]byte, len(texts))
+		for i, text := range texts {
+			gzs[i], err = gzipText(text)
+			if err != nil {
+				return err
+			}
+		}
+		// there's nothing to clean up, since everything happens in the one transaction
+		abandon = func() {}
+	} else {
+		// reserve the Id for every revision
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			if exists(tx) {
+				return ErrExists
+			}
+			for i, revision := range revisions {
+				err := putPending(tx, paste.Id, revision.Rev, hashes[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// save every text, unless it's already there
+		for i := range revisions {
+			err := s.writeBlob(hashes[i], texts[i])
+			if err != nil {
+				abandon()
+				return err
+			}
+		}
+	}
+
+	// and commit
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if inBolt {
+			if exists(tx) {
+				return ErrExists
+			}
+			for i := range revisions {
+				err := refBlob(tx, hashes[i])
+				if err != nil {
+					return err
+				}
+				err = putText(tx, hashes[i], gzs[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if paste.Visibility == "public" {
+			err := rod.PutString(tx, publicBucketNameStr, paste.Id, paste.Created.Format("20060201-150405.000000000"))
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, revision := range revisions {
+			revision.Hash = hashes[i]
+			err := putRevision(tx, paste.Id, revision)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := rod.PutJson(tx, pasteBucketNameStr, paste.Id, paste)
+		if err != nil {
+			return err
+		}
+
+		err = rod.Del(tx, tombstoneBucketNameStr, paste.Id)
+		if err != nil {
+			return err
+		}
+
+		for _, revision := range revisions {
+			err := rod.Del(tx, pendingBucketNameStr, pendingKey(paste.Id, revision.Rev))
+			if err != nil {
+				return err
+			}
+		}
+
+		// the paste keeps its old times, so an incremental dump wouldn't pick it up
+		return needFullDump(tx)
+	})
+	if err != nil {
+		abandon()
+		return err
+	}
+
+	return nil
+}
+
+func (s *BoltStore) ListPublic(fn func(id string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(publicBucketName)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			err := fn(string(k))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltStore) Iterate(fn func(paste Paste) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for _, v := c.First(); v != nil; _, v = c.Next() {
+			paste := Paste{}
+			err := json.Unmarshal(v, &paste)
+			if err != nil {
+				return err
+			}
+			err = fn(paste)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltStore) PublicExists(hash string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = isPublicBlob(tx, hash)
+		return nil
+	})
+	return exists, err
+}
+
+// Recover cleans up every write which was still pending when we last stopped, by removing the files (and any temporary
+// files) and the pending writes themselves. Since a write is committed in the same transaction which removes it from
+// pending, nothing still pending was ever committed. This should only be called on startup, before any other writes.
+func (s *BoltStore) Recover() (int, error) {
+	pending := make([]pendingWrite, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pendingBucketName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			p := pendingWrite{}
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pending {
+		log.Printf("Recovering unfinished write of %s (revision %d) from %s\n", p.Id, p.Rev, p.Started.Format(time.RFC3339))
+		err := s.abandon(p.Id, p.Rev)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(pending), nil
+}
+
+// pendingWrite records a file being written for this revision of a paste, and the blob it references.
+type pendingWrite struct {
+	Id      string
+	Rev     int
+	Hash    string
+	Started time.Time
+}
+
+func pendingKey(id string, rev int) string {
+	return id + "." + strconv.Itoa(rev)
+}
+
+// putPending records the pending write, and references its blob so that it can't be removed before the write is done.
+func putPending(tx *bolt.Tx, id string, rev int, hash string) error {
+	err := refBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	p := pendingWrite{Id: id, Rev: rev, Hash: hash, Started: time.Now().UTC()}
+	return rod.PutJson(tx, pendingBucketNameStr, pendingKey(id, rev), p)
+}
+
+// tombstone records when a paste was deleted.
+type tombstone struct {
+	Id      string
+	Deleted time.Time
+}
+
+func putTombstone(tx *bolt.Tx, id string) error {
+	return rod.PutJson(tx, tombstoneBucketNameStr, id, tombstone{Id: id, Deleted: time.Now().UTC()})
+}
+
+// pruneTombstones removes all tombstones from before t, returning how many were removed.
+func pruneTombstones(db *bolt.DB, t time.Time) (int, error) {
+	pruned := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tombstoneBucketName)
+		if b == nil {
+			return nil
+		}
+
+		old := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			ts := tombstone{}
+			err := json.Unmarshal(v, &ts)
+			if err != nil {
+				return err
+			}
+			if ts.Deleted.Before(t) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+		return nil
+	})
+	return pruned, err
+}
+
+// abandon removes a pending write which won't be committed, along with the file (and temporary file) it was writing.
+// Any errors are also logged since this is usually called whilst already handling another error.
+func (s *BoltStore) abandon(id string, rev int) error {
+	// writes from before blobs were to the paste's own file
+	filename := pasteFilename(s.dir, id, rev)
+	flat := flatPasteFilename(s.dir, id, rev)
+	for _, f := range []string{filename + ".tmp", filename, flat + ".tmp", flat} {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Err removing abandoned file: %s\n", err)
+			return err
+		}
+	}
+
+	// remove the pending write, and its reference to the blob
+	hash, last := "", false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		p := pendingWrite{}
+		err := rod.GetJson(tx, pendingBucketNameStr, pendingKey(id, rev), &p)
+		if err != nil {
+			return err
+		}
+		if p.Id == "" {
+			// already gone
+			return nil
+		}
+		if p.Hash != "" {
+			hash = p.Hash
+			last, err = unrefBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+		}
+		return rod.Del(tx, pendingBucketNameStr, pendingKey(id, rev))
+	})
+	if err != nil {
+		log.Printf("Err removing pending write: %s\n", err)
+		return err
+	}
+
+	if last {
+		err = s.removeBlob(hash)
+		if err != nil {
+			log.Printf("Err removing abandoned blob: %s\n", err)
+		}
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file next to filename, syncs it, and then renames it into place, so that
+// filename is either not there or complete. The dir is also synced so that the rename itself survives a crash.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+
+	err := makeParentDirs(filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// syncDir syncs a dir, so that any files created, renamed or removed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func revisionKey(rev int) string {
+	// zero padded so they sort in order
+	return fmt.Sprintf("%08d", rev)
+}
+
+// putRevision saves the revision, and indexes its blob if the paste is public. The paste must already be in the public
+// bucket for that, so public pastes are always put there first.
+func putRevision(tx *bolt.Tx, id string, revision Revision) error {
+	err := rod.PutJson(tx, revisionBucketNameStr+"."+id, revisionKey(revision.Rev), revision)
+	if err != nil || revision.Hash == "" {
+		return err
+	}
+	public, err := rod.Get(tx, publicBucketNameStr, id)
+	if err != nil || public == nil {
+		return err
+	}
+	return rod.Put(tx, publicBlobBucketNameStr, publicBlobKey(revision.Hash, id), []byte{})
+}
+
+// getRevisions returns all revisions of this paste in order. Pastes created before revisions existed don't have any
+// stored, so their only revision is made up from the paste itself.
+func getRevisions(tx *bolt.Tx, paste Paste) ([]Revision, error) {
+	revisions := make([]Revision, 0)
+
+	b, err := rod.GetBucket(tx, revisionBucketNameStr+"."+paste.Id)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			revision := Revision{}
+			err := json.Unmarshal(v, &revision)
+			if err != nil {
+				return nil, err
+			}
+			revisions = append(revisions, revision)
+		}
+	}
+
+	if len(revisions) == 0 {
+		revisions = append(revisions, Revision{Rev: 1, Size: paste.Size, Created: paste.Created})
+	}
+
+	return revisions, nil
+}
+
+// delRevisions removes the revision bucket for this paste, and its blobs from the public blob index.
+func delRevisions(tx *bolt.Tx, id string) error {
+	b := tx.Bucket(revisionBucketName)
+	if b == nil {
+		return nil
+	}
+	if rb := b.Bucket([]byte(id)); rb != nil {
+		err := rb.ForEach(func(k, v []byte) error {
+			revision := Revision{}
+			err := json.Unmarshal(v, &revision)
+			if err != nil || revision.Hash == "" {
+				return err
+			}
+			return rod.Del(tx, publicBlobBucketNameStr, publicBlobKey(revision.Hash, id))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := b.DeleteBucket([]byte(id))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
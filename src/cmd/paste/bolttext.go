@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// With PASTE_STORAGE=bolt each blob is kept in the datastore instead of dir, gzipped just like a blob file and split
+// into chunks so that a big paste doesn't need one huge value:
+//
+//     text.9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 -> 00000000, 00000001, ...
+//
+// It is reference counted in the blob bucket like any other blob, so the only difference is where the bytes are. A
+// paste can then be saved in one transaction, and a dump of the DB has everything in it. Blobs still in dir (from
+// before switching) are read from there until compressEvery moves them in.
+var textBucketNameStr = "text"
+var textBucketName = []byte(textBucketNameStr)
+
+const textChunkSize = 64 * 1024
+
+func textChunkKey(i int) string {
+	return fmt.Sprintf("%08d", i)
+}
+
+// hasText says whether the blob is kept in the datastore.
+func hasText(tx *bolt.Tx, hash string) bool {
+	b := tx.Bucket(textBucketName)
+	return b != nil && b.Bucket([]byte(hash)) != nil
+}
+
+// putText keeps the blob's gzipped text in the datastore, unless it is already there.
+func putText(tx *bolt.Tx, hash string, gz []byte) error {
+	if hasText(tx, hash) {
+		return nil
+	}
+	for i := 0; i*textChunkSize < len(gz); i++ {
+		end := (i + 1) * textChunkSize
+		if end > len(gz) {
+			end = len(gz)
+		}
+		err := rod.Put(tx, textBucketNameStr+"."+hash, textChunkKey(i), gz[i*textChunkSize:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getText returns the blob's gzipped text (copied, so it can be used after the transaction), or nil if it isn't kept
+// in the datastore.
+func getText(tx *bolt.Tx, hash string) ([]byte, error) {
+	b := tx.Bucket(textBucketName)
+	if b == nil {
+		return nil, nil
+	}
+	b = b.Bucket([]byte(hash))
+	if b == nil {
+		return nil, nil
+	}
+
+	buf := &bytes.Buffer{}
+	err := b.ForEach(func(k, v []byte) error {
+		_, err := buf.Write(v)
+		return err
+	})
+	return buf.Bytes(), err
+}
+
+// textSize returns the uncompressed size of the blob kept in the datastore from the gzip trailer at the end of its
+// last chunk (see gzipSize).
+func textSize(tx *bolt.Tx, hash string) (int64, error) {
+	b := tx.Bucket(textBucketName)
+	if b != nil {
+		b = b.Bucket([]byte(hash))
+	}
+	if b == nil {
+		return 0, nil
+	}
+	_, last := b.Cursor().Last()
+	if len(last) < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int64(binary.LittleEndian.Uint32(last[len(last)-4:])), nil
+}
+
+// delText removes the blob from the datastore, if it is there.
+func delText(tx *bolt.Tx, hash string) error {
+	b := tx.Bucket(textBucketName)
+	if b == nil {
+		return nil
+	}
+	err := b.DeleteBucket([]byte(hash))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// pruneText removes every blob kept in the datastore which has no references in refs (from countBlobRefs), returning
+// their hashes.
+func pruneText(tx *bolt.Tx, refs map[string]int) ([]string, error) {
+	b := tx.Bucket(textBucketName)
+	if b == nil {
+		return nil, nil
+	}
+
+	// find them first, since we can't delete whilst iterating
+	unused := make([]string, 0)
+	err := b.ForEach(func(k, v []byte) error {
+		if refs[string(k)] == 0 {
+			unused = append(unused, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range unused {
+		err := delText(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return unused, nil
+}
+
+// newTextReader returns a reader for gzipped text from getText.
+func newTextReader(gz []byte) io.ReadCloser {
+	return &gzipFile{f: ioutil.NopCloser(bytes.NewReader(gz))}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// Text compresses very well, so blobs are stored gzipped next to where the plain blob would be:
+//
+//     blobs.sha256/9f/86/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.gz
+//
+// The hash is always of the uncompressed text, and so is Revision.Size. Plain blobs (and files from before blobs) are
+// still read as they are, and compressEvery compresses them whilst the server is running.
+const gzipExt = ".gz"
+
+// gzipFile is the text of a revision which is stored gzipped. Reading it gives the text.
+type gzipFile struct {
+	f  io.ReadCloser
+	zr *gzip.Reader
+}
+
+func (g *gzipFile) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.f)
+		if err != nil {
+			return 0, err
+		}
+		g.zr = zr
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipFile) Close() error {
+	return g.f.Close()
+}
+
+// Gzipped returns the text still gzipped, exactly as it is stored, so it can be sent as it is to clients which accept
+// gzip. Use either this or Read, not both.
+func (g *gzipFile) Gzipped() io.Reader {
+	return g.f
+}
+
+// gzipper is implemented by text from Store.Open which is stored gzipped.
+type gzipper interface {
+	Gzipped() io.Reader
+}
+
+// gzipText returns the text gzipped.
+func gzipText(text []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zw.Write(text)
+	if err == nil {
+		err = zw.Close()
+	}
+	return buf.Bytes(), err
+}
+
+// gzipSize returns the uncompressed size of a gzipped file from its trailer, without decompressing it. (The trailer
+// only has the size modulo 4GiB, which is far more than any paste.)
+func gzipSize(filename string) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	trailer := make([]byte, 4)
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < int64(len(trailer)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	_, err = f.ReadAt(trailer, info.Size()-int64(len(trailer)))
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+// acceptsGzip says whether the client sent `Accept-Encoding: gzip` (without turning it off again with `q=0`).
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// sendText streams the text of a paste, passing it through still gzipped if that's how it is stored and the client
+// accepts gzip.
+func sendText(w http.ResponseWriter, r *http.Request, text io.Reader) error {
+	if gz, ok := text.(gzipper); ok {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			text = gz.Gzipped()
+		}
+	}
+	_, err := io.Copy(streamWriter(w, r), text)
+	return err
+}
+
+// Call it with something like:
+//
+//     go compressEvery(ctx, store, time.Duration(1)*time.Hour)
+//
+// to compress every plain paste file once straight away and then every so often (to catch anything restored in the
+// meantime), until ctx is done.
+func compressEvery(ctx context.Context, s *BoltStore, d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.compressAll(ctx)
+		if err != nil {
+			log.Printf("Err compressing paste files: %s\n", err)
+		}
+		if n > 0 {
+			log.Printf("Compressed %d paste file(s)\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// compressAll compresses the text of every revision which isn't already (moving it into bolt or object storage if
+// that's where blobs are kept), stopping early if ctx is done. It returns how many files were compressed.
+func (s *BoltStore) compressAll(ctx context.Context) (int, error) {
+	// find everything first, since we can't write whilst iterating
+	type todo struct {
+		id       string
+		revision Revision
+		inBolt   bool
+	}
+	todos := make([]todo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			paste := Paste{}
+			err := json.Unmarshal(v, &paste)
+			if err != nil {
+				return err
+			}
+			revisions, err := getRevisions(tx, paste)
+			if err != nil {
+				return err
+			}
+			inBolt := s.textInBolt(paste)
+			for _, revision := range revisions {
+				if revision.Hash != "" {
+					if hasText(tx, revision.Hash) {
+						continue
+					}
+					filename := blobFilename(s.dir, revision.Hash)
+					if s.objects != nil && !fileExists(filename+gzipExt) && !fileExists(filename) {
+						// anything not in dir is already in object storage
+						continue
+					}
+					if s.objects == nil && !inBolt && fileExists(filename+gzipExt) {
+						continue
+					}
+				}
+				todos = append(todos, todo{paste.Id, revision, inBolt})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	done := make(map[string]bool)
+	for _, t := range todos {
+		if ctx.Err() != nil {
+			break
+		}
+		if done[t.revision.Hash] {
+			// shared with a revision already done
+			continue
+		}
+		var err error
+		switch {
+		case t.revision.Hash == "":
+			err = s.moveToBlob(t.id, t.revision, t.inBolt)
+		case s.objects != nil:
+			err = s.moveBlobToObjects(t.revision.Hash)
+		case t.inBolt:
+			err = s.moveBlobToBolt(t.revision.Hash)
+		default:
+			err = s.compressBlob(t.revision.Hash)
+		}
+		done[t.revision.Hash] = t.revision.Hash != ""
+		if err != nil {
+			log.Printf("Err compressing revision %d of %s: %s\n", t.revision.Rev, t.id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// compressBlob replaces a plain blob with a gzipped one. Anyone who already has the plain one open can carry on
+// reading it.
+func (s *BoltStore) compressBlob(hash string) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	filename := blobFilename(s.dir, hash)
+	if _, err := os.Stat(filename + gzipExt); err == nil {
+		// already done, and the plain one was left behind
+		return removeFile(filename)
+	}
+
+	text, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		// removed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	gz, err := gzipText(text)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filename+gzipExt, gz)
+	if err != nil {
+		return err
+	}
+	return removeFile(filename)
+}
+
+// moveBlobToBolt moves a blob from dir into the text bucket.
+func (s *BoltStore) moveBlobToBolt(hash string) error {
+	return s.moveBlobFile(hash, func(gz []byte) error {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			refs, err := blobRefs(tx, hash)
+			if err != nil || refs == 0 {
+				return err
+			}
+			return putText(tx, hash, gz)
+		})
+	})
+}
+
+// moveBlobToObjects moves a blob from dir into object storage.
+func (s *BoltStore) moveBlobToObjects(hash string) error {
+	return s.moveBlobFile(hash, func(gz []byte) error {
+		refs := 0
+		err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			refs, err = blobRefs(tx, hash)
+			return err
+		})
+		if err != nil || refs == 0 {
+			return err
+		}
+		_, err = s.putObject(hash, gz)
+		return err
+	})
+}
+
+// moveBlobFile moves a blob from dir to wherever put keeps it, then removes the file. put is given the blob gzipped,
+// and should skip it if nothing references the blob any more. Anyone who already has the file open can carry on
+// reading it.
+func (s *BoltStore) moveBlobFile(hash string, put func(gz []byte) error) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	gz, err := s.readBlobGzipped(hash)
+	if os.IsNotExist(err) {
+		// removed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = put(gz)
+	if err != nil {
+		return err
+	}
+
+	// now the files aren't needed either way, apart from by a dump which started before the move
+	return s.afterDumps(func() error {
+		filename := blobFilename(s.dir, hash)
+		for _, f := range []string{filename, filename + gzipExt} {
+			err := removeFile(f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readBlobGzipped reads the blob from dir, gzipping it if it isn't already.
+func (s *BoltStore) readBlobGzipped(hash string) ([]byte, error) {
+	f, gzipped, err := openRevisionFile(s.dir, "", Revision{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || gzipped {
+		return data, err
+	}
+	return gzipText(data)
+}
+
+// moveToBlob moves the text of a revision from before blobs into a gzipped blob (in dir, bolt if inBolt, or object
+// storage), and points the revision at it.
+func (s *BoltStore) moveToBlob(id string, revision Revision, inBolt bool) error {
+	f, err := openPasteFile(s.dir, id, revision.Rev)
+	if os.IsNotExist(err) {
+		// deleted in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	hash := hashText(text)
+
+	// hold the blob lock until the revision refers to it, so it can't be removed in between
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	gz, err := gzipText(text)
+	if err != nil {
+		return err
+	}
+	filename := blobFilename(s.dir, hash)
+	written := false
+	switch {
+	case inBolt, fileExists(filename + gzipExt), fileExists(filename):
+	case s.objects != nil:
+		written, err = s.putObject(hash, gz)
+		if err != nil {
+			return err
+		}
+	default:
+		err = writeFileAtomic(filename+gzipExt, gz)
+		if err != nil {
+			return err
+		}
+		written = true
+	}
+
+	moved := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil || paste.Id == "" {
+			return err
+		}
+		revisions, err := getRevisions(tx, paste)
+		if err != nil {
+			return err
+		}
+		for _, r := range revisions {
+			if r.Rev != revision.Rev || r.Hash != "" {
+				continue
+			}
+			r.Hash = hash
+			err := putRevision(tx, id, r)
+			if err != nil {
+				return err
+			}
+			if inBolt {
+				err := putText(tx, hash, gz)
+				if err != nil {
+					return err
+				}
+			}
+			moved = true
+			err = refBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+			// the revision keeps its old time, so an incremental dump wouldn't pick up the new hash
+			return needFullDump(tx)
+		}
+		return nil
+	})
+	if err == nil && !moved && written {
+		// the paste went in the meantime, so nothing uses the new blob
+		if s.objects != nil {
+			err = s.objects.Delete(s.objects.blobKey(hash))
+		} else {
+			err = removeFile(filename + gzipExt)
+		}
+	}
+	if err != nil || !moved {
+		return err
+	}
+
+	// now that nothing refers to the old files, they can go (once any dump which started before the move is done)
+	return s.afterDumps(func() error {
+		for _, f := range []string{pasteFilename(s.dir, id, revision.Rev), flatPasteFilename(s.dir, id, revision.Rev)} {
+			err := removeFile(f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeFile removes a file if it is there.
+func removeFile(filename string) error {
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
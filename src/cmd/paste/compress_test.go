@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestSendTextGzip(t *testing.T) {
+	store, _ := newBoltStore(t)
+	srv := newStoreServer(t, store)
+	paste := createPaste(t, store, "hello, world")
+	stored, err := ioutil.ReadFile(blobFilename(store.dir, hashText([]byte("hello, world"))) + gzipExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// don't let the client ask for (and undo) gzip by itself
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"", false},
+		{"deflate", false},
+		{"gzip;q=0", false},
+	}
+	for _, path := range []string{"/" + paste.Id + ".txt", "/dl/" + paste.Id} {
+		for _, test := range tests {
+			req, err := http.NewRequest("GET", srv.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s returned an error: %s", path, err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("reading GET %s returned an error: %s", path, err)
+			}
+
+			want, wantEncoding := "hello, world", ""
+			if test.gzipped {
+				want, wantEncoding = string(stored), "gzip"
+			}
+			if encoding := res.Header.Get("Content-Encoding"); encoding != wantEncoding {
+				t.Errorf("GET %s with Accept-Encoding %q sent Content-Encoding %q, want %q",
+					path, test.acceptEncoding, encoding, wantEncoding)
+			}
+			if string(body) != want {
+				t.Errorf("GET %s with Accept-Encoding %q sent %q, want %q", path, test.acceptEncoding, body, want)
+			}
+		}
+	}
+}
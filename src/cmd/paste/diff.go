@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	diffEqual  = "equal"
+	diffDelete = "delete"
+	diffInsert = "insert"
+)
+
+// diffContext is the number of unchanged lines shown around each change, the same as `diff -u`.
+const diffContext = 3
+
+// DiffLine is one line of a diff. A is the line number in the old text and B the line number in the new text, either
+// of which is 0 if the line isn't in that text.
+type DiffLine struct {
+	Op        string // equal, delete, insert
+	Text      string
+	A         int
+	B         int
+	NoNewline bool // the last line of a text which doesn't end with a newline
+}
+
+// DiffHunk is a group of changed lines along with the unchanged lines around them.
+type DiffHunk struct {
+	AStart int
+	ALen   int
+	BStart int
+	BLen   int
+	Lines  []DiffLine
+}
+
+// Header returns the "@@ -1,4 +1,5 @@" line for this hunk.
+func (h DiffHunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.AStart, h.ALen), hunkRange(h.BStart, h.BLen))
+}
+
+// Rows returns the lines of this hunk paired up for a side-by-side diff.
+func (h DiffHunk) Rows() []DiffRow {
+	return sideBySide(h.Lines)
+}
+
+// DiffRow is one row of a side-by-side diff. Either side may be empty (an Op of "") if the line only exists on the
+// other side.
+type DiffRow struct {
+	Left  DiffLine
+	Right DiffLine
+}
+
+func hunkRange(start, length int) string {
+	if length == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+// splitLines splits text into lines, each keeping its "\n" so that a last line without one differs from the same line
+// with one, as it does for `diff`. A trailing newline doesn't make an extra empty line.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// newDiffLine makes a DiffLine from a line from splitLines.
+func newDiffLine(op, line string, a, b int) DiffLine {
+	return DiffLine{
+		Op:        op,
+		Text:      strings.TrimSuffix(line, "\n"),
+		A:         a,
+		B:         b,
+		NoNewline: !strings.HasSuffix(line, "\n"),
+	}
+}
+
+// diffMaxCost is the most edits diffLines searches for either side of a middle snake. Past that, the two parts left
+// are so different that it gives up and replaces one with the other, which keeps the time taken by a big edit down.
+const diffMaxCost = 4096
+
+// diffLines returns the shortest edit from a to b (both from splitLines), using the linear space version of the Myers
+// diff algorithm. It finds the middle of the shortest edit (the middle snake) and then does the same for each half,
+// so only needs two arrays the size of the texts however many lines differ.
+//
+// See : http://www.xmailserver.org/diff2.pdf
+func diffLines(a, b []string) []DiffLine {
+	max := (len(a)+len(b)+1)/2 + 1
+	if max > diffMaxCost+1 {
+		max = diffMaxCost + 1
+	}
+	d := &differ{
+		a:      a,
+		b:      b,
+		lines:  make([]DiffLine, 0, len(a)+len(b)),
+		vf:     make([]int, 2*max+1),
+		vb:     make([]int, 2*max+1),
+		offset: max,
+	}
+	d.diff(0, len(a), 0, len(b))
+	return d.lines
+}
+
+// differ keeps the state of diffLines. vf and vb are the furthest x reached on each diagonal k (at offset+k) going
+// forwards from the start and backwards from the end.
+type differ struct {
+	a, b   []string
+	lines  []DiffLine
+	vf, vb []int
+	offset int
+}
+
+// diff appends the lines of the shortest edit from a[aLo:aHi] to b[bLo:bHi].
+func (d *differ) diff(aLo, aHi, bLo, bHi int) {
+	// the same lines at the start and end don't need searching
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.lines = append(d.lines, newDiffLine(diffEqual, d.a[aLo], aLo+1, bLo+1))
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aHi > aLo && bHi > bLo && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+		suffix++
+	}
+
+	switch {
+	case aLo == aHi:
+		for y := bLo; y < bHi; y++ {
+			d.lines = append(d.lines, newDiffLine(diffInsert, d.b[y], 0, y+1))
+		}
+	case bLo == bHi:
+		for x := aLo; x < aHi; x++ {
+			d.lines = append(d.lines, newDiffLine(diffDelete, d.a[x], x+1, 0))
+		}
+	default:
+		x, y, u, v, ok := d.middleSnake(aLo, aHi, bLo, bHi)
+		if !ok {
+			// too different to be worth finding the shortest edit
+			for i := aLo; i < aHi; i++ {
+				d.lines = append(d.lines, newDiffLine(diffDelete, d.a[i], i+1, 0))
+			}
+			for i := bLo; i < bHi; i++ {
+				d.lines = append(d.lines, newDiffLine(diffInsert, d.b[i], 0, i+1))
+			}
+			break
+		}
+		d.diff(aLo, x, bLo, y)
+		for ; x < u; x, y = x+1, y+1 {
+			d.lines = append(d.lines, newDiffLine(diffEqual, d.a[x], x+1, y+1))
+		}
+		d.diff(u, aHi, v, bHi)
+	}
+
+	for i := 0; i < suffix; i++ {
+		d.lines = append(d.lines, newDiffLine(diffEqual, d.a[aHi+i], aHi+i+1, bHi+i+1))
+	}
+}
+
+// middleSnake finds the snake (the run of equal lines from x, y to u, v) in the middle of the shortest edit from
+// a[aLo:aHi] to b[bLo:bHi], by searching forwards from the start and backwards from the end until the two meet. Both
+// must be non-empty, and start and end with different lines, so that there are edits either side of it. It returns
+// false if there are more than diffMaxCost edits either side.
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (x, y, u, v int, ok bool) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	vf, vb, offset := d.vf, d.vb, d.offset
+	vf[offset+1] = 0
+	vb[offset+1] = 0
+
+	for D := 0; D <= (n+m+1)/2; D++ {
+		if D > diffMaxCost {
+			return 0, 0, 0, 0, false
+		}
+
+		// forwards, with x and y counted from aLo and bLo
+		for k := -D; k <= D; k += 2 {
+			var fx int
+			if k == -D || (k != D && vf[offset+k-1] < vf[offset+k+1]) {
+				fx = vf[offset+k+1]
+			} else {
+				fx = vf[offset+k-1] + 1
+			}
+			fy := fx - k
+			sx, sy := fx, fy
+			for fx < n && fy < m && d.a[aLo+fx] == d.b[bLo+fy] {
+				fx++
+				fy++
+			}
+			vf[offset+k] = fx
+			// the backwards search has only been as far as D-1, on diagonal delta-k
+			if odd && k >= delta-(D-1) && k <= delta+(D-1) && fx+vb[offset+delta-k] >= n {
+				return aLo + sx, bLo + sy, aLo + fx, bLo + fy, true
+			}
+		}
+
+		// backwards, with x and y counted back from aHi and bHi
+		for k := -D; k <= D; k += 2 {
+			var bx int
+			if k == -D || (k != D && vb[offset+k-1] < vb[offset+k+1]) {
+				bx = vb[offset+k+1]
+			} else {
+				bx = vb[offset+k-1] + 1
+			}
+			by := bx - k
+			sx, sy := bx, by
+			for bx < n && by < m && d.a[aHi-1-bx] == d.b[bHi-1-by] {
+				bx++
+				by++
+			}
+			vb[offset+k] = bx
+			if !odd && k >= delta-D && k <= delta+D && bx+vf[offset+delta-k] >= n {
+				return aHi - bx, bHi - by, aHi - sx, bHi - sy, true
+			}
+		}
+	}
+
+	// the search always meets before the end, since both halves are at most half of n+m
+	return 0, 0, 0, 0, false
+}
+
+// diffHunks groups the changed lines into hunks with up to context unchanged lines either side.
+func diffHunks(lines []DiffLine, context int) []DiffHunk {
+	hunks := make([]DiffHunk, 0)
+
+	i := 0
+	for i < len(lines) {
+		// skip to the next change
+		if lines[i].Op == diffEqual {
+			i++
+			continue
+		}
+
+		// start far enough back to include the context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// keep going until there are more than 2*context equal lines in a row (or we run out)
+		last := i
+		for j := i; j < len(lines) && j-last <= 2*context; j++ {
+			if lines[j].Op != diffEqual {
+				last = j
+			}
+		}
+		end := last + context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		hunk := DiffHunk{Lines: lines[start:end]}
+		for _, line := range hunk.Lines {
+			if line.Op != diffInsert {
+				hunk.ALen++
+				if hunk.AStart == 0 {
+					hunk.AStart = line.A
+				}
+			}
+			if line.Op != diffDelete {
+				hunk.BLen++
+				if hunk.BStart == 0 {
+					hunk.BStart = line.B
+				}
+			}
+		}
+		// an empty side starts at the line before, as `diff -u` does
+		if hunk.ALen == 0 {
+			hunk.AStart = precedingLine(lines[:start], true)
+		}
+		if hunk.BLen == 0 {
+			hunk.BStart = precedingLine(lines[:start], false)
+		}
+
+		hunks = append(hunks, hunk)
+		i = end
+	}
+
+	return hunks
+}
+
+// precedingLine returns the last line number on the A side (or B side) in lines, or 0 if there isn't one.
+func precedingLine(lines []DiffLine, a bool) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if a && lines[i].A > 0 {
+			return lines[i].A
+		}
+		if !a && lines[i].B > 0 {
+			return lines[i].B
+		}
+	}
+	return 0
+}
+
+// sideBySide pairs up the lines of each hunk for showing the old and new text next to each other. Deleted lines are
+// shown alongside the inserted lines which replaced them.
+func sideBySide(lines []DiffLine) []DiffRow {
+	rows := make([]DiffRow, 0, len(lines))
+
+	i := 0
+	for i < len(lines) {
+		if lines[i].Op == diffEqual {
+			rows = append(rows, DiffRow{Left: lines[i], Right: lines[i]})
+			i++
+			continue
+		}
+
+		// collect this run of deletes and inserts
+		deletes := make([]DiffLine, 0)
+		inserts := make([]DiffLine, 0)
+		for i < len(lines) && lines[i].Op != diffEqual {
+			if lines[i].Op == diffDelete {
+				deletes = append(deletes, lines[i])
+			} else {
+				inserts = append(inserts, lines[i])
+			}
+			i++
+		}
+
+		for j := 0; j < len(deletes) || j < len(inserts); j++ {
+			row := DiffRow{}
+			if j < len(deletes) {
+				row.Left = deletes[j]
+			}
+			if j < len(inserts) {
+				row.Right = inserts[j]
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+// writeUnifiedDiff writes the hunks in the same format as `diff -u`, including its marker after a last line without a
+// newline.
+func writeUnifiedDiff(w io.Writer, aName, bName string, hunks []DiffHunk) error {
+	_, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", aName, bName)
+	if err != nil {
+		return err
+	}
+
+	for _, hunk := range hunks {
+		_, err := fmt.Fprintf(w, "%s\n", hunk.Header())
+		if err != nil {
+			return err
+		}
+		for _, line := range hunk.Lines {
+			prefix := " "
+			if line.Op == diffDelete {
+				prefix = "-"
+			} else if line.Op == diffInsert {
+				prefix = "+"
+			}
+			_, err := fmt.Fprintf(w, "%s%s\n", prefix, line.Text)
+			if err != nil {
+				return err
+			}
+			if line.NoNewline {
+				_, err := fmt.Fprint(w, "\\ No newline at end of file\n")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		diff string
+	}{
+		{"both empty", "", "", ""},
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"from empty", "", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+		{"to empty", "a\n", "", "@@ -1 +0,0 @@\n-a\n"},
+		{"insert", "a\nb\n", "a\nx\nb\n", "@@ -1,2 +1,3 @@\n a\n+x\n b\n"},
+		{"delete", "a\nb\nc\nd\n", "b\nc\n", "@@ -1,4 +1,2 @@\n-a\n b\n c\n-d\n"},
+		{"newline removed", "a\n", "a", "@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n"},
+		{"newline added", "a", "a\n", "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+a\n"},
+		{
+			"neither has a newline",
+			"a\nb",
+			"a\nc",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+	}
+
+	for _, test := range tests {
+		hunks := diffHunks(diffLines(splitLines(test.a), splitLines(test.b)), diffContext)
+		buf := bytes.Buffer{}
+		err := writeUnifiedDiff(&buf, "a", "b", hunks)
+		if err != nil {
+			t.Fatalf("%s: writeUnifiedDiff() returned an error: %s", test.name, err)
+		}
+		want := "--- a\n+++ b\n" + test.diff
+		if buf.String() != want {
+			t.Errorf("%s: diff is\n%s\nnot\n%s", test.name, buf.String(), want)
+		}
+	}
+}
+
+func TestDiffLinesEveryLineChanged(t *testing.T) {
+	// small enough to search all of, and so big that it gives up
+	for _, n := range []int{3000, 50000} {
+		a := make([]string, n)
+		b := make([]string, n)
+		for i := range a {
+			a[i] = fmt.Sprintf("a%d\n", i)
+			b[i] = fmt.Sprintf("b%d\n", i)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		lines := diffLines(a, b)
+		runtime.ReadMemStats(&after)
+
+		// the memory used grows with the texts, not with how different they are
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(n)*1024 {
+			t.Errorf("%d lines: diffLines() allocated %d bytes", n, alloc)
+		}
+		deletes, inserts := 0, 0
+		for _, line := range lines {
+			switch line.Op {
+			case diffDelete:
+				deletes++
+			case diffInsert:
+				inserts++
+			default:
+				t.Fatalf("%d lines: diffLines() found an equal line %q", n, line.Text)
+			}
+		}
+		if deletes != n || inserts != n {
+			t.Fatalf("%d lines: diffLines() has %d deletes and %d inserts", n, deletes, inserts)
+		}
+	}
+}
@@ -3,60 +3,395 @@ package main
 // From : https://gist.github.com/chilts/687ec1e8c5337213a7e1a5de2d3584ae
 
 import (
+	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
+// Each dump is a tar.gz containing a snapshot of the DB, every paste file the snapshot refers to, and a manifest of
+// checksums:
+//
+//     paste.db
+//     paste/TtysPe
+//     paste/TtysPe.2
+//     ...
+//     MANIFEST
+//
+// The MANIFEST is in the same format as `sha256sum`, so an extracted dump can be checked with `sha256sum -c MANIFEST`.
+const (
+	dumpDbName       = "paste.db"
+	dumpPasteDirName = "paste"
+	dumpManifestName = "MANIFEST"
+)
+
 // Call it with something like:
 //
-//     go dumpEvery(db, time.Duration(15)*time.Minute, "/var/lib/project/dump")
+//     go dumpEvery(ctx, store, time.Duration(15)*time.Minute, "/var/lib/project/dump", defaultRetention)
 //
-// for every 15 mins.
+// for every 15 mins, until ctx is done. Old dumps are pruned after each new one according to ret.
 //
 // $ ls -l
 // total 20
-// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095936.db.gz
-// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095946.db.gz
-// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095956.db.gz
-// -rwx------ 1 chilts chilts 1222 Mar 29 10:00 20170329-100006.db.gz
-// -rwx------ 1 chilts chilts 1222 Mar 29 10:00 20170329-100016.db.gz
-func dumpEvery(db *bolt.DB, d time.Duration, dir string) {
+// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095936.tar.gz
+// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095946.tar.gz
+// -rwx------ 1 chilts chilts 1075 Mar 29 09:59 20170329-095956.tar.gz
+// -rwx------ 1 chilts chilts 1222 Mar 29 10:00 20170329-100006.tar.gz
+// -rwx------ 1 chilts chilts 1222 Mar 29 10:00 20170329-100016.tar.gz
+func dumpEvery(ctx context.Context, s *BoltStore, d time.Duration, dir string, ret retention) {
 	ticker := time.NewTicker(d)
+	defer ticker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
 			// do stuff
 			log.Println("Dumping the DB now")
-			dump(db, dir)
+			dumpAndPrune(s, dir, ret)
 		}
 	}
 }
 
-func dump(db *bolt.DB, dir string) error {
-	filename := path.Join(dir, time.Now().Format("20060102-150405")+".db.gz")
-	fmt.Printf("filename=%s\n", filename)
+// dumpAndPrune writes a full dump and verifies it. Only once the new dump is known to be good are old tombstones and
+// dumps pruned. Everything is logged rather than returned, since there's no one to return it to.
+func dumpAndPrune(s *BoltStore, dir string, ret retention) {
+	started := time.Now()
+	filename, err := dump(s, dir)
+	if err != nil {
+		log.Printf("Error dumping the DB: %s\n", err)
+		return
+	}
 
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0700)
+	// check the dump can actually be restored from, and if not, keep everything we have until someone looks
+	_, _, err = verifyDump(filename, func(problem string) {
+		log.Printf("!!! DUMP PROBLEM in %s: %s\n", filename, problem)
+	})
+	if err != nil {
+		log.Printf("!!! DUMP VERIFICATION FAILED for %s: %s (not pruning anything)\n", filename, err)
+		return
+	}
+	log.Printf("Dump %s verified\n", filename)
+
+	err = fullDumpDone(s.db, started)
+	if err != nil {
+		log.Printf("Error recording the full dump: %s\n", err)
+	}
+
+	// incremental dumps from now on start after this one, so older tombstones aren't needed
+	pruned, err := pruneTombstones(s.db, started.Add(-incrementalOverlap))
+	if err != nil {
+		log.Printf("Error pruning tombstones: %s\n", err)
+	} else if pruned > 0 {
+		log.Printf("Pruned %d tombstone(s)\n", pruned)
+	}
+
+	err = pruneDumps(dir, ret)
+	if err != nil {
+		log.Printf("Error pruning dumps: %s\n", err)
+	}
+}
+
+// dump writes a full dump of the store into dir, returning its filename.
+func dump(s *BoltStore, dir string) (string, error) {
+	filename := path.Join(dir, time.Now().Format(dumpTimeFormat)+".tar.gz")
+
+	// nothing in the snapshot is removed until the dump is done, so the files still match it
+	s.startDump()
+	defer s.endDump()
+
+	// Copy the snapshot first and dump everything from the copy. Bolt can't grow the DB whilst a transaction is open,
+	// so holding one whilst every file (or object) is read would hold up writes for the whole dump.
+	snapshot := filename + ".db.tmp"
+	defer os.Remove(snapshot)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(snapshot, 0600)
+	})
+	if err != nil {
+		return "", err
+	}
+	db, err := bolt.Open(snapshot, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	files := 0
+	err = writeDump(filename, func(tw *tar.Writer, manifest io.Writer) error {
+		return db.View(func(tx *bolt.Tx) error {
+			err := writeDumpEntry(tw, manifest, dumpDbName, tx.Size(), time.Now(), tx.WriteTo)
+			if err != nil {
+				return err
+			}
+			log.Printf("DB Dump written %d bytes\n", tx.Size())
+
+			b := tx.Bucket(pasteBucketName)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				paste := Paste{}
+				err := json.Unmarshal(v, &paste)
+				if err != nil {
+					return err
+				}
+
+				if !dumpsText(paste) {
+					return nil
+				}
+
+				revisions, err := getRevisions(tx, paste)
+				if err != nil {
+					return err
+				}
+				for _, revision := range revisions {
+					if revision.Hash != "" && hasText(tx, revision.Hash) {
+						// already in the DB
+						continue
+					}
+					err := dumpPasteFile(tw, manifest, s, paste.Id, revision, nil)
+					if err != nil {
+						return err
+					}
+					files++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Paste files written %d\n", files)
+	return filename, nil
+}
+
+// dumpsText says whether the text of this paste goes into dumps. Burn after reading pastes are only meant to exist
+// until they are read, so their text is left out, and a dump of one can only be restored without its text (which
+// `paste fsck -repair` then removes). With PASTE_STORAGE=bolt their text is still kept in dir (see textInBolt), so it
+// isn't part of the DB snapshot either.
+func dumpsText(paste Paste) bool {
+	return !paste.Burn
+}
+
+// writeDump creates a dump called filename, with fn writing everything apart from the MANIFEST. It is written to a
+// temporary file first so a half written dump is never mistaken for a good one.
+func writeDump(filename string, fn func(tw *tar.Writer, manifest io.Writer) error) error {
+	f, err := os.OpenFile(filename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(filename + ".tmp")
 	defer f.Close()
 
 	// gzip the output
 	zw := gzip.NewWriter(f)
-	defer zw.Close()
+	tw := tar.NewWriter(zw)
+	manifest := bytes.Buffer{}
+
+	err = fn(tw, &manifest)
+	if err != nil {
+		return err
+	}
+
+	// and finally the manifest, which isn't in itself
+	err = writeDumpEntry(tw, nil, dumpManifestName, int64(manifest.Len()), time.Now(), manifest.WriteTo)
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		n, err := tx.WriteTo(zw)
-		log.Printf("DB Dump written %d bytes\n", n)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// dumpPasteFile adds the text of one revision to the dump, from gz (from getText) if it is kept in bolt or from its
+// file (or object). Files are never changed once written, and nothing is removed whilst a dump runs (see startDump),
+// so a missing file is an error.
+func dumpPasteFile(tw *tar.Writer, manifest io.Writer, s *BoltStore, id string, revision Revision, gz []byte) error {
+	rev := revision.Rev
+	name := dumpPasteDirName + "/" + pasteBasename(id, rev)
+	if gz != nil {
+		r := newTextReader(gz)
+		return writeDumpEntry(tw, manifest, name, int64(revision.Size), revision.Created, func(w io.Writer) (int64, error) {
+			return io.Copy(w, r)
+		})
+	}
+
+	f, gzipped, err := openRevisionFile(s.dir, id, revision)
+	if os.IsNotExist(err) && s.objects != nil && revision.Hash != "" {
+		// dumps have everything needed to restore, so the text comes out of object storage too
+		var r io.ReadCloser
+		r, err = s.openObject(revision.Hash)
+		if err == nil {
+			defer r.Close()
+			return writeDumpEntry(tw, manifest, name, int64(revision.Size), revision.Created, func(w io.Writer) (int64, error) {
+				return io.Copy(w, r)
+			})
+		}
+	}
+	if err != nil {
 		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// dumps always have a plain flat file for each revision, whatever the layout of PASTE_DIR, so gzipped blobs are
+	// decompressed on the way in
+	var r io.Reader = f
+	size := info.Size()
+	if gzipped {
+		r = &gzipFile{f: f}
+		size = int64(revision.Size)
+	}
+	return writeDumpEntry(tw, manifest, name, size, info.ModTime(), func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
 	})
+}
+
+// writeDumpEntry writes one file of size bytes to the dump, adding its checksum to the manifest (if there is one).
+func writeDumpEntry(tw *tar.Writer, manifest io.Writer, name string, size int64, modTime time.Time,
+	write func(io.Writer) (int64, error)) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	n, err := write(io.MultiWriter(tw, h))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: wrote %d bytes, expected %d", name, n, size)
+	}
+
+	if manifest != nil {
+		_, err = fmt.Fprintf(manifest, "%x  %s\n", h.Sum(nil), name)
+	}
 	return err
 }
+
+// readDump reads every entry in a dump (full or incremental), passing each one (apart from the MANIFEST) to fn, and
+// then checks every checksum against the MANIFEST. Anything fn doesn't read is still checksummed.
+func readDump(r io.Reader, fn func(name string, r io.Reader) error) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	sums := make(map[string]string)
+	var manifest []byte
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// a dump which has been extracted and repacked by hand may have dirs in it
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Name == dumpManifestName {
+			manifest, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !isDumpEntryName(hdr.Name) {
+			return fmt.Errorf("unexpected file %s in dump", hdr.Name)
+		}
+
+		h := sha256.New()
+		tee := io.TeeReader(tr, h)
+		err = fn(hdr.Name, tee)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, tee)
+		if err != nil {
+			return err
+		}
+		sums[hdr.Name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("no %s in dump", dumpManifestName)
+	}
+	// every line is "<sha256>  <name>"
+	listed := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid line in %s: %q", dumpManifestName, line)
+		}
+		sum, ok := sums[parts[1]]
+		if !ok {
+			return fmt.Errorf("%s is in the %s but not in the dump", parts[1], dumpManifestName)
+		}
+		if sum != parts[0] {
+			return fmt.Errorf("%s: checksum mismatch", parts[1])
+		}
+		listed++
+	}
+	if listed != len(sums) {
+		return fmt.Errorf("%d file(s) in the dump are not in the %s", len(sums)-listed, dumpManifestName)
+	}
+
+	return nil
+}
+
+// isDumpEntryName says whether name is something dump() or dumpIncremental() writes, so nothing can be written outside
+// of where it's restored to.
+func isDumpEntryName(name string) bool {
+	if name == dumpDbName || name == dumpChangesName {
+		return true
+	}
+	if !strings.HasPrefix(name, dumpPasteDirName+"/") {
+		return false
+	}
+	base := strings.TrimPrefix(name, dumpPasteDirName+"/")
+	return base != "" && base != "." && base != ".." && !strings.Contains(base, "/")
+}
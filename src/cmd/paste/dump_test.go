@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// newBoltStore returns a BoltStore keeping its blobs in a temporary dir, and a dir to write dumps to.
+func newBoltStore(t *testing.T) (*BoltStore, string) {
+	dir, err := ioutil.TempDir("", "paste-dump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := bolt.Open(filepath.Join(dir, "paste.db"), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store, err := NewBoltStore(db, filepath.Join(dir, "raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumpDir := filepath.Join(dir, "dump")
+	err = os.Mkdir(dumpDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dumpDir
+}
+
+func TestDumpWhilstDeleting(t *testing.T) {
+	store, dumpDir := newBoltStore(t)
+
+	a := createPaste(t, store, "hello")
+	createPaste(t, store, "world")
+	blob := blobFilename(store.dir, hashText([]byte("hello"))) + gzipExt
+
+	// whilst another dump is running, deleting a paste leaves its blob for that dump to read
+	store.startDump()
+	_, err := store.Delete(a.Id)
+	if err != nil {
+		t.Fatalf("Delete() returned an error: %s", err)
+	}
+	if !fileExists(blob) {
+		t.Fatalf("%s was removed whilst a dump was running", blob)
+	}
+
+	filename, err := dump(store, dumpDir)
+	if err != nil {
+		t.Fatalf("dump() returned an error: %s", err)
+	}
+	pastes, files, err := verifyDump(filename, func(problem string) {
+		t.Errorf("verifyDump() found a problem: %s", problem)
+	})
+	if err != nil {
+		t.Fatalf("verifyDump() returned an error: %s", err)
+	}
+	if pastes != 1 || files != 1 {
+		t.Fatalf("dump has %d pastes and %d files, not 1 and 1", pastes, files)
+	}
+	// the copy of the snapshot it was written from has gone
+	names, err := filepath.Glob(filepath.Join(dumpDir, "*"))
+	if err != nil || len(names) != 1 || names[0] != filename {
+		t.Fatalf("dump dir has %v, not just %s", names, filename)
+	}
+
+	store.endDump()
+	if fileExists(blob) {
+		t.Fatalf("%s is still there after the dumps finished", blob)
+	}
+}
+
+func TestBurnTextStaysOutOfBolt(t *testing.T) {
+	store, dumpDir := newBoltStore(t)
+	store.inBolt = true
+
+	kept := createPaste(t, store, "hello")
+	now := time.Now().UTC()
+	burn := Paste{Visibility: "unlisted", Burn: true, Size: 5, Revision: 1, Created: now, Updated: now}
+	burn, err := store.Create(burn, []byte("burnt"), NewRandomIdAllocator(idChars, 6))
+	if err != nil {
+		t.Fatalf("Create() returned an error: %s", err)
+	}
+
+	// only the burn after reading paste has its text in dir
+	err = store.db.View(func(tx *bolt.Tx) error {
+		if !hasText(tx, hashText([]byte("hello"))) {
+			t.Errorf("the text of %s isn't in bolt", kept.Id)
+		}
+		if hasText(tx, hashText([]byte("burnt"))) {
+			t.Errorf("the text of burn after reading paste %s is in bolt", burn.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := readPaste(t, store, burn.Id); text != "burnt" {
+		t.Fatalf("paste is %q", text)
+	}
+
+	// and compressing doesn't move it in either
+	_, err = store.compressAll(context.Background())
+	if err != nil {
+		t.Fatalf("compressAll() returned an error: %s", err)
+	}
+	if !fileExists(blobFilename(store.dir, hashText([]byte("burnt"))) + gzipExt) {
+		t.Fatalf("the text of %s was moved out of dir", burn.Id)
+	}
+
+	// so the dump has neither its text nor a file for it
+	filename, err := dump(store, dumpDir)
+	if err != nil {
+		t.Fatalf("dump() returned an error: %s", err)
+	}
+	pastes, files, err := verifyDump(filename, func(problem string) {
+		t.Errorf("verifyDump() found a problem: %s", problem)
+	})
+	if err != nil {
+		t.Fatalf("verifyDump() returned an error: %s", err)
+	}
+	if pastes != 2 || files != 0 {
+		t.Fatalf("dump has %d pastes and %d files, not 2 and 0", pastes, files)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// The expiry options offered on the new paste form, keyed on the value sent in the form. A zero duration means the
+// paste never expires.
+var expireDurations = map[string]time.Duration{
+	"10m":   time.Duration(10) * time.Minute,
+	"1h":    time.Duration(1) * time.Hour,
+	"1d":    time.Duration(24) * time.Hour,
+	"1w":    time.Duration(7*24) * time.Hour,
+	"never": 0,
+}
+
+// Call it with something like:
+//
+//     go reapEvery(ctx, store, time.Duration(1)*time.Minute)
+//
+// to remove any expired pastes every minute, until ctx is done.
+func reapEvery(ctx context.Context, store Store, d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := reap(store)
+			if err != nil {
+				log.Printf("Err reaping expired pastes: %s\n", err)
+			}
+		}
+	}
+}
+
+// reap removes all expired pastes from the store.
+func reap(store Store) error {
+	now := time.Now().UTC()
+
+	// find all expired pastes first, since we can't delete whilst iterating
+	ids := make([]string, 0)
+	err := store.Iterate(func(paste Paste) error {
+		if paste.HasExpired(now) {
+			ids = append(ids, paste.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, err := store.Delete(id)
+		if err != nil {
+			log.Printf("Err removing expired paste %s: %s\n", id, err)
+		}
+	}
+
+	if len(ids) > 0 {
+		log.Printf("Reaped %d expired paste(s)\n", len(ids))
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+// exportedPaste is one line of an export. It has all of the paste's fields, the text of its latest revision, and the
+// text of every earlier revision (if there are any). Text which isn't UTF-8 is base64 encoded.
+type exportedPaste struct {
+	Paste
+	Body     string
+	Encoding string             `json:",omitempty"` // "base64" if Body isn't UTF-8
+	History  []exportedRevision `json:",omitempty"`
+}
+
+// exportedRevision is an earlier revision of an exportedPaste.
+type exportedRevision struct {
+	Revision
+	Body     string
+	Encoding string `json:",omitempty"`
+}
+
+// exportCmd is the `paste export` command, which writes every paste as a line of JSON to stdout (or -o). Burn after
+// reading pastes are left out, since their text is only meant to exist until it has been read.
+func exportCmd(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbFilename := flags.String("db", "paste.db", "the datastore to export")
+	out := flags.String("o", "-", "the file to export to")
+	flags.Parse(args)
+
+	dir := os.Getenv("PASTE_DIR")
+	if dir == "" {
+		return errors.New("Specify the dir pastefiles are in with 'PASTE_DIR'")
+	}
+
+	objects, err := newS3ClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(*dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the server still running?): %s", *dbFilename, err)
+	}
+	defer db.Close()
+
+	// read-only, so the buckets aren't created like NewBoltStore would
+	store := &BoltStore{db: db, dir: dir, objects: objects}
+
+	w := os.Stdout
+	if *out != "-" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	n, burnt := 0, 0
+	err = store.Iterate(func(paste Paste) error {
+		if paste.Burn {
+			burnt++
+			return nil
+		}
+
+		revisions, err := store.Revisions(paste.Id)
+		if err != nil {
+			return err
+		}
+
+		line := exportedPaste{Paste: paste}
+		for _, revision := range revisions {
+			text, err := readText(store, paste.Id, revision.Rev)
+			if err != nil {
+				return fmt.Errorf("revision %d of %s: %s", revision.Rev, paste.Id, err)
+			}
+			body, encoding := encodeBody(text)
+			if revision.Rev == paste.LatestRevision() {
+				line.Body, line.Encoding = body, encoding
+			} else {
+				line.History = append(line.History, exportedRevision{revision, body, encoding})
+			}
+		}
+
+		n++
+		return enc.Encode(line)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d pastes, leaving out %d burn after reading pastes\n", n, burnt)
+	return nil
+}
+
+// importCmd is the `paste import` command, which saves every paste from an export read from stdin (or the file
+// given). Pastes keep their Ids and timestamps, and any paste whose Id is already in use is reported and skipped.
+func importCmd(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbFilename := flags.String("db", "paste.db", "the datastore to import into")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		return errors.New("Usage: paste import [-db paste.db] [file]")
+	}
+
+	dir := os.Getenv("PASTE_DIR")
+	if dir == "" {
+		return errors.New("Specify the dir to write pastefiles to with 'PASTE_DIR'")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	objects, err := newS3ClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := bolt.Open(*dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the server still running?): %s", *dbFilename, err)
+	}
+	defer db.Close()
+
+	store, err := NewBoltStore(db, dir)
+	if err != nil {
+		return err
+	}
+	store.objects = objects
+
+	imported, conflicts, failed := 0, 0, 0
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		line := exportedPaste{}
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("paste %d: %s", n, err)
+		}
+
+		paste, revisions, texts, err := line.unpack()
+		if err == nil {
+			err = store.Import(paste, revisions, texts)
+		}
+		if err == ErrExists {
+			fmt.Printf("conflict: %s already exists, skipping\n", paste.Id)
+			conflicts++
+			continue
+		}
+		if err != nil {
+			fmt.Printf("error: paste %d (%s): %s\n", n, paste.Id, err)
+			failed++
+			continue
+		}
+		imported++
+	}
+
+	fmt.Printf("Imported %d pastes, %d conflicts, %d errors\n", imported, conflicts, failed)
+	if conflicts > 0 || failed > 0 {
+		return fmt.Errorf("%d pastes were not imported", conflicts+failed)
+	}
+	return nil
+}
+
+// unpack returns the paste, all of its revisions and their texts. Sizes come from the texts themselves.
+func (line exportedPaste) unpack() (Paste, []Revision, [][]byte, error) {
+	paste := line.Paste
+	revisions := make([]Revision, 0, len(line.History)+1)
+	texts := make([][]byte, 0, len(line.History)+1)
+
+	for _, hist := range line.History {
+		text, err := decodeBody(hist.Body, hist.Encoding)
+		if err != nil {
+			return paste, nil, nil, fmt.Errorf("revision %d: %s", hist.Rev, err)
+		}
+		hist.Revision.Size = len(text)
+		revisions = append(revisions, hist.Revision)
+		texts = append(texts, text)
+	}
+
+	text, err := decodeBody(line.Body, line.Encoding)
+	if err != nil {
+		return paste, nil, nil, err
+	}
+	created := paste.Updated
+	if created.IsZero() {
+		created = paste.Created
+	}
+	paste.Size = len(text)
+	revisions = append(revisions, Revision{Rev: paste.LatestRevision(), Size: paste.Size, Created: created})
+	texts = append(texts, text)
+
+	return paste, revisions, texts, nil
+}
+
+func readText(store Store, id string, rev int) ([]byte, error) {
+	rc, err := store.Open(id, rev)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// encodeBody returns the text as it is if it's UTF-8, otherwise base64 encoded along with the encoding used.
+func encodeBody(text []byte) (string, string) {
+	if utf8.Valid(text) {
+		return string(text), ""
+	}
+	return base64.StdEncoding.EncodeToString(text), "base64"
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(body)
+	default:
+		return nil, fmt.Errorf("unknown encoding '%s'", encoding)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestExportImport(t *testing.T) {
+	store, dumpDir := newBoltStore(t)
+
+	plain := createPaste(t, store, "hello")
+	binary := createPaste(t, store, "\xff\xfe\x00binary")
+	edited := createPaste(t, store, "first")
+	for _, text := range []string{"second", "third"} {
+		_, err := store.Revise(edited.Id, "Edited", []byte(text))
+		if err != nil {
+			t.Fatalf("Revise() returned an error: %s", err)
+		}
+	}
+	now := time.Now().UTC()
+	burn := Paste{Visibility: "unlisted", Burn: true, Size: 4, Revision: 1, Created: now, Updated: now}
+	burn, err := store.Create(burn, []byte("burn"), NewRandomIdAllocator(idChars, 6))
+	if err != nil {
+		t.Fatalf("Create() returned an error: %s", err)
+	}
+
+	// export everything, then import it somewhere new
+	dbFilename := store.db.Path()
+	store.db.Close()
+	exported := filepath.Join(dumpDir, "export.jsonl")
+	t.Setenv("PASTE_DIR", store.dir)
+	err = exportCmd([]string{"-db", dbFilename, "-o", exported})
+	if err != nil {
+		t.Fatalf("exportCmd() returned an error: %s", err)
+	}
+	importedDb := filepath.Join(dumpDir, "imported.db")
+	importedDir := filepath.Join(dumpDir, "imported")
+	t.Setenv("PASTE_DIR", importedDir)
+	err = importCmd([]string{"-db", importedDb, exported})
+	if err != nil {
+		t.Fatalf("importCmd() returned an error: %s", err)
+	}
+
+	db, err := bolt.Open(dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	original := &BoltStore{db: db, dir: store.dir}
+	db, err = bolt.Open(importedDb, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	imported := &BoltStore{db: db, dir: importedDir}
+
+	// marshalling gets rid of any differences in how the times are held
+	same := func(a, b interface{}) bool {
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		return string(ja) == string(jb)
+	}
+	for _, id := range []string{plain.Id, binary.Id, edited.Id} {
+		want, err := original.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s) returned an error: %s", id, err)
+		}
+		got, err := imported.Get(id)
+		if err != nil {
+			t.Fatalf("imported Get(%s) returned an error: %s", id, err)
+		}
+		if !same(got, want) {
+			t.Errorf("imported paste is %+v, want %+v", got, want)
+		}
+
+		wantRevisions, err := original.Revisions(id)
+		if err != nil {
+			t.Fatalf("Revisions(%s) returned an error: %s", id, err)
+		}
+		gotRevisions, err := imported.Revisions(id)
+		if err != nil {
+			t.Fatalf("imported Revisions(%s) returned an error: %s", id, err)
+		}
+		if !same(gotRevisions, wantRevisions) {
+			t.Errorf("imported revisions of %s are %+v, want %+v", id, gotRevisions, wantRevisions)
+			continue
+		}
+
+		for _, revision := range wantRevisions {
+			wantText, err := readText(original, id, revision.Rev)
+			if err != nil {
+				t.Fatalf("reading revision %d of %s returned an error: %s", revision.Rev, id, err)
+			}
+			gotText, err := readText(imported, id, revision.Rev)
+			if err != nil {
+				t.Fatalf("reading imported revision %d of %s returned an error: %s", revision.Rev, id, err)
+			}
+			if string(gotText) != string(wantText) {
+				t.Errorf("imported revision %d of %s is %q, want %q", revision.Rev, id, gotText, wantText)
+			}
+		}
+	}
+
+	// burn after reading pastes stay behind
+	if _, err := imported.Get(burn.Id); err != ErrNotFound {
+		t.Errorf("burn after reading paste %s was imported", burn.Id)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// fsck is the `paste fsck` command. It checks that PASTE_DIR and the datastore agree with each other and reports:
+//
+// * files with no paste (or revision) in the datastore
+// * pastes (or revisions) whose file is missing
+// * public keys with no paste
+// * sizes in the datastore which don't match the file
+// * writes which were never finished
+// * files in the wrong shard, or in more than one place
+// * blobs which nothing uses, or whose reference count is wrong
+//
+// With PASTE_STORAGE=s3 the objects in the bucket are checked too, though only that they are there (since their sizes
+// aren't known without fetching them).
+//
+// With -repair the datastore is opened read-write and each problem is fixed. Pastes whose latest revision is missing
+// are removed entirely, since there is nothing left to serve.
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix any problems found")
+	dbFilename := flags.String("db", "paste.db", "the datastore to check")
+	flags.Parse(args)
+
+	dir := os.Getenv("PASTE_DIR")
+	if dir == "" {
+		return errors.New("Specify the dir pastefiles are in with 'PASTE_DIR'")
+	}
+	objects, err := newS3ClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// read-only unless we're repairing, but either way this waits for the server to let go
+	db, err := bolt.Open(*dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: !*repair})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the server still running?): %s", *dbFilename, err)
+	}
+	defer db.Close()
+
+	// read everything we know about from the datastore
+	pastes := make(map[string]Paste)
+	revisions := make(map[string][]Revision)
+	public := make([]string, 0)
+	pending := make(map[string]bool)
+	refs := make(map[string]int)
+	wanted := make(map[string]int)
+	texts := make(map[string]int64)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				paste := Paste{}
+				err := json.Unmarshal(v, &paste)
+				if err != nil {
+					return fmt.Errorf("paste %s: %s", k, err)
+				}
+				pastes[paste.Id] = paste
+				revisions[paste.Id], err = getRevisions(tx, paste)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = tx.Bucket(publicBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				public = append(public, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = tx.Bucket(pendingBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				pending[string(k)] = true
+				p := pendingWrite{}
+				err := json.Unmarshal(v, &p)
+				if err == nil && p.Hash != "" {
+					wanted[p.Hash]++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = tx.Bucket(textBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				size, err := textSize(tx, string(k))
+				if err != nil {
+					return fmt.Errorf("text %s: %s", k, err)
+				}
+				texts[string(k)] = size
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = tx.Bucket(blobBucketName)
+		if b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				n, err := strconv.Atoi(string(v))
+				if err != nil {
+					return fmt.Errorf("blob %s: %s", k, err)
+				}
+				refs[string(k)] = n
+				return nil
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// and every file in dir (in either layout), with its size, and every blob
+	files := make(map[string]int64)
+	paths := make(map[string]string)
+	dupes := make([]string, 0)
+	misplaced := make([]string, 0)
+	blobs := make(map[string]int64)
+	blobPaths := make(map[string]string)
+	strays := make([]string, 0)
+	blobDir := filepath.Join(dir, blobDirName) + string(filepath.Separator)
+	err = filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if filename == dir && os.IsNotExist(err) {
+			// nothing has been written there, e.g. with everything in object storage
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// e.g. a restore in progress
+			if filename != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := info.Name()
+		if strings.HasPrefix(filename, blobDir) {
+			hash := strings.TrimSuffix(name, gzipExt)
+			if filename != blobFilename(dir, hash) && filename != blobFilename(dir, hash)+gzipExt {
+				// unfinished writes, or anything else which isn't a blob
+				strays = append(strays, filename)
+				return nil
+			}
+
+			// the size is always of the text, however it is stored
+			size := info.Size()
+			if strings.HasSuffix(name, gzipExt) {
+				size, err = gzipSize(filename)
+				if err != nil {
+					return err
+				}
+			}
+
+			// a plain blob left behind after compressing it
+			if other, ok := blobPaths[hash]; ok {
+				if strings.HasSuffix(name, gzipExt) {
+					dupes = append(dupes, other)
+				} else {
+					dupes = append(dupes, filename)
+					return nil
+				}
+			}
+			blobs[hash] = size
+			blobPaths[hash] = filename
+			return nil
+		}
+
+		id, rev, _ := parsePasteFilename(name)
+		sharded := filename == pasteFilename(dir, id, rev) || filename == pasteFilename(dir, id, rev)+".tmp"
+		if !sharded && filepath.Dir(filename) != dir {
+			// still counts as being there, it just needs moving
+			misplaced = append(misplaced, filename)
+		}
+
+		// the same file in more than one place, so keep the sharded one
+		if other, ok := paths[name]; ok {
+			if sharded {
+				dupes = append(dupes, other)
+			} else {
+				dupes = append(dupes, filename)
+				return nil
+			}
+		}
+		files[name] = info.Size()
+		paths[name] = filename
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// and every object in the bucket
+	objectKeys := make(map[string]string)
+	deadObjects := make([]string, 0)
+	if objects != nil {
+		blobPrefix := objects.prefix + blobDirName + "/"
+		err = objects.List(blobPrefix, func(key string, size int64) error {
+			hash := strings.TrimSuffix(strings.TrimPrefix(key, blobPrefix), gzipExt)
+			if key != objects.blobKey(hash) || !isHash(hash) {
+				deadObjects = append(deadObjects, key)
+				return nil
+			}
+			objectKeys[hash] = key
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		problems++
+		fmt.Printf(format+"\n", a...)
+	}
+
+	for _, key := range deadObjects {
+		report("object in %s which isn't a blob: %s", objects.bucket, key)
+	}
+
+	// blobs kept in bolt (or object storage) don't need their file as well, and a size of -1 is one we don't know
+	for hash, key := range objectKeys {
+		if _, ok := texts[hash]; ok {
+			report("duplicate object: %s", key)
+			deadObjects = append(deadObjects, key)
+			delete(objectKeys, hash)
+		}
+	}
+	for hash, filename := range blobPaths {
+		_, inBolt := texts[hash]
+		_, inObjects := objectKeys[hash]
+		if inBolt || inObjects {
+			dupes = append(dupes, filename)
+			delete(blobs, hash)
+			delete(blobPaths, hash)
+		}
+	}
+	for hash, size := range texts {
+		blobs[hash] = size
+	}
+	for hash := range objectKeys {
+		blobs[hash] = -1
+	}
+	sort.Strings(dupes)
+
+	for _, filename := range dupes {
+		report("duplicate file: %s", filename)
+	}
+	for _, filename := range strays {
+		if strings.HasSuffix(filename, ".tmp") {
+			report("unfinished write: %s", filename)
+		} else {
+			report("file in %s which isn't a blob: %s", blobDirName, filename)
+		}
+	}
+	for _, filename := range misplaced {
+		if paths[filepath.Base(filename)] == filename {
+			report("file in the wrong shard: %s", filename)
+		}
+	}
+
+	// files with nothing in the datastore (including temporary files from unfinished writes)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	orphans := make([]string, 0)
+	for _, name := range names {
+		id, rev, tmp := parsePasteFilename(name)
+		if tmp || pending[pendingKey(id, rev)] {
+			report("unfinished write: %s", paths[name])
+			orphans = append(orphans, paths[name])
+			continue
+		}
+		paste, ok := pastes[id]
+		if !ok {
+			report("file with no paste: %s", paths[name])
+			orphans = append(orphans, paths[name])
+			continue
+		}
+		if rev > paste.LatestRevision() {
+			report("file with no revision: %s", paths[name])
+			orphans = append(orphans, paths[name])
+		}
+	}
+
+	// pastes with missing files or mismatched sizes
+	missing := make([]string, 0)
+	resized := make(map[string][]Revision)
+	ids := make([]string, 0, len(pastes))
+	for id := range pastes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		paste := pastes[id]
+		for _, revision := range revisions[id] {
+			name := pasteBasename(id, revision.Rev)
+			size, ok := files[name]
+			if revision.Hash != "" {
+				wanted[revision.Hash]++
+				name = blobDirName + "/" + revision.Hash
+				size, ok = blobs[revision.Hash]
+			}
+			if !ok {
+				report("missing file: %s (revision %d of %s)", name, revision.Rev, id)
+				if revision.Rev == paste.LatestRevision() {
+					missing = append(missing, id)
+				}
+				continue
+			}
+			if size >= 0 && int64(revision.Size) != size {
+				report("size mismatch: %s (revision %d of %s) is %d bytes, not %d", name, revision.Rev, id, size, revision.Size)
+				revision.Size = int(size)
+				resized[id] = append(resized[id], revision)
+			}
+		}
+	}
+
+	// blobs which nothing uses, and reference counts which are wrong
+	hashes := make([]string, 0, len(blobs))
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if wanted[hash] == 0 {
+			if filename, ok := blobPaths[hash]; ok {
+				report("blob with no revision: %s", filename)
+			} else if key, ok := objectKeys[hash]; ok {
+				report("blob with no revision: %s (in %s)", key, objects.bucket)
+			} else {
+				report("blob with no revision: %s (in %s)", hash, *dbFilename)
+			}
+		}
+	}
+	hashes = hashes[:0]
+	for hash := range refs {
+		hashes = append(hashes, hash)
+	}
+	for hash := range wanted {
+		if _, ok := refs[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		if refs[hash] != wanted[hash] {
+			report("blob %s has %d reference(s), not %d", hash, refs[hash], wanted[hash])
+		}
+	}
+
+	// public keys with no paste
+	dangling := make([]string, 0)
+	for _, id := range public {
+		if _, ok := pastes[id]; !ok {
+			report("public key with no paste: %s", id)
+			dangling = append(dangling, id)
+		}
+	}
+
+	fmt.Printf("Checked %d pastes, %d files and %d blobs, found %d problem(s)\n",
+		len(pastes), len(files), len(blobs), problems)
+	if problems == 0 || !*repair {
+		if problems > 0 {
+			return errors.New("problems found, run again with -repair to fix them")
+		}
+		return nil
+	}
+
+	// now repair everything in the datastore
+	var counted map[string]int
+	err = db.Update(func(tx *bolt.Tx) error {
+		for key := range pending {
+			err := rod.Del(tx, pendingBucketNameStr, key)
+			if err != nil {
+				return err
+			}
+		}
+		for _, id := range missing {
+			err := rod.Del(tx, pasteBucketNameStr, id)
+			if err != nil {
+				return err
+			}
+			err = rod.Del(tx, publicBucketNameStr, id)
+			if err != nil {
+				return err
+			}
+			err = rod.Del(tx, viewsBucketNameStr, id)
+			if err != nil {
+				return err
+			}
+			err = delRevisions(tx, id)
+			if err != nil {
+				return err
+			}
+			err = putTombstone(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+		for _, id := range dangling {
+			err := rod.Del(tx, publicBucketNameStr, id)
+			if err != nil {
+				return err
+			}
+		}
+		for id, changed := range resized {
+			if contains(missing, id) {
+				continue
+			}
+			paste := pastes[id]
+			for _, revision := range changed {
+				err := putRevision(tx, id, revision)
+				if err != nil {
+					return err
+				}
+				if revision.Rev == paste.LatestRevision() {
+					paste.Size = revision.Size
+				}
+			}
+			err := rod.PutJson(tx, pasteBucketNameStr, id, paste)
+			if err != nil {
+				return err
+			}
+		}
+
+		// and recount the blob references, now that the pending writes and missing pastes have gone
+		var err error
+		counted, err = countBlobRefs(tx)
+		if err != nil {
+			return err
+		}
+		err = indexPublicBlobs(tx)
+		if err != nil {
+			return err
+		}
+		_, err = pruneText(tx, counted)
+		if err != nil {
+			return err
+		}
+		// none of the repairs change a paste's times, so an incremental dump wouldn't pick them up
+		return needFullDump(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	// and the files (and objects), now that nothing refers to them
+	for hash, filename := range blobPaths {
+		if counted[hash] == 0 {
+			orphans = append(orphans, filename)
+		}
+	}
+	for hash, key := range objectKeys {
+		if counted[hash] == 0 {
+			deadObjects = append(deadObjects, key)
+		}
+	}
+	for _, key := range deadObjects {
+		err := objects.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, filename := range append(append(orphans, dupes...), strays...) {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, filename := range misplaced {
+		name := filepath.Base(filename)
+		if paths[name] != filename {
+			// a duplicate, which has already gone
+			continue
+		}
+		id, rev, _ := parsePasteFilename(name)
+		err := makeParentDirs(pasteFilename(dir, id, rev))
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filename, pasteFilename(dir, id, rev))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, id := range missing {
+		err := removePasteFiles(dir, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Repaired %d problem(s)\n", problems)
+	return nil
+}
+
+// parsePasteFilename is the reverse of pasteBasename, e.g. "TtysPe" is revision 1 of "TtysPe" and "TtysPe.2" is
+// revision 2. Temporary files from writeFileAtomic end with ".tmp".
+func parsePasteFilename(name string) (id string, rev int, tmp bool) {
+	tmp = strings.HasSuffix(name, ".tmp")
+	name = strings.TrimSuffix(name, ".tmp")
+
+	parts := strings.SplitN(name, ".", 2)
+	id = parts[0]
+	rev = 1
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		if err == nil {
+			rev = n
+		}
+	}
+	return
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
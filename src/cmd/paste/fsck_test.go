@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+func TestFsckRepairs(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, store *BoltStore, paste Paste)
+		check  func(t *testing.T, tx *bolt.Tx, paste Paste)
+	}{
+		{
+			"missing file",
+			func(t *testing.T, store *BoltStore, paste Paste) {
+				err := removeFile(blobFilename(store.dir, hashText([]byte("hello"))) + gzipExt)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(t *testing.T, tx *bolt.Tx, paste Paste) {
+				// there's nothing left to serve, so the paste goes
+				if v, _ := rod.Get(tx, pasteBucketNameStr, paste.Id); v != nil {
+					t.Errorf("paste %s is still there", paste.Id)
+				}
+				if v, _ := rod.Get(tx, tombstoneBucketNameStr, paste.Id); v == nil {
+					t.Errorf("paste %s has no tombstone", paste.Id)
+				}
+				if refs, _ := blobRefs(tx, hashText([]byte("hello"))); refs != 0 {
+					t.Errorf("blob still has %d reference(s)", refs)
+				}
+			},
+		},
+		{
+			"orphan blob",
+			func(t *testing.T, store *BoltStore, paste Paste) {
+				gz, err := gzipText([]byte("orphan"))
+				if err == nil {
+					err = writeFileAtomic(blobFilename(store.dir, hashText([]byte("orphan")))+gzipExt, gz)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			nil,
+		},
+		{
+			"bad refcount",
+			func(t *testing.T, store *BoltStore, paste Paste) {
+				err := store.db.Update(func(tx *bolt.Tx) error {
+					return rod.PutString(tx, blobBucketNameStr, hashText([]byte("hello")), "5")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(t *testing.T, tx *bolt.Tx, paste Paste) {
+				if refs, _ := blobRefs(tx, hashText([]byte("hello"))); refs != 1 {
+					t.Errorf("blob has %d reference(s), not 1", refs)
+				}
+			},
+		},
+		{
+			"dangling public key",
+			func(t *testing.T, store *BoltStore, paste Paste) {
+				err := store.db.Update(func(tx *bolt.Tx) error {
+					return rod.PutString(tx, publicBucketNameStr, "gone", time.Now().Format(time.RFC3339))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(t *testing.T, tx *bolt.Tx, paste Paste) {
+				if v, _ := rod.Get(tx, publicBucketNameStr, "gone"); v != nil {
+					t.Errorf("public key is still there")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		store, _ := newBoltStore(t)
+		paste := createPaste(t, store, "hello")
+		createPaste(t, store, "world")
+		test.damage(t, store, paste)
+
+		// fsck needs the datastore to itself
+		dbFilename := store.db.Path()
+		store.db.Close()
+		t.Setenv("PASTE_DIR", store.dir)
+
+		err := fsck([]string{"-db", dbFilename})
+		if err == nil || !strings.Contains(err.Error(), "problems found") {
+			t.Fatalf("%s: fsck() returned %v, not that problems were found", test.name, err)
+		}
+		err = fsck([]string{"-db", dbFilename, "-repair"})
+		if err != nil {
+			t.Fatalf("%s: fsck -repair returned an error: %s", test.name, err)
+		}
+		err = fsck([]string{"-db", dbFilename})
+		if err != nil {
+			t.Fatalf("%s: fsck() after repairing returned an error: %s", test.name, err)
+		}
+
+		// and everything else is still fine
+		if fileExists(blobFilename(store.dir, hashText([]byte("orphan"))) + gzipExt) {
+			t.Errorf("%s: orphan blob is still there", test.name)
+		}
+		if !fileExists(blobFilename(store.dir, hashText([]byte("world"))) + gzipExt) {
+			t.Errorf("%s: blob of another paste was removed", test.name)
+		}
+		db, err := bolt.Open(dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.check != nil {
+			db.View(func(tx *bolt.Tx) error {
+				test.check(t, tx, paste)
+				return nil
+			})
+		}
+		db.Close()
+	}
+}
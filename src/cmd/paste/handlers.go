@@ -4,11 +4,56 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
+// requestTimeout is how long a handler has to read the request and write the response, apart from the text of a
+// paste, which is streamed for as long as the client keeps reading it.
+var requestTimeout = time.Duration(60) * time.Second
+
+// streamTimeout is how long a client may go without reading any more of the text of a paste.
+var streamTimeout = time.Duration(30) * time.Second
+
+type controllerKey struct{}
+
+// withDeadlines gives every request requestTimeout to be read and written, and keeps a ResponseController in the
+// context so that streamWriter can move the write deadline on.
+func withDeadlines(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(requestTimeout)
+		// not every ResponseWriter supports deadlines (e.g. in tests), so carry on without them
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), controllerKey{}, rc)))
+	})
+}
+
+// streamWriter returns a writer which gives each write streamTimeout, so a large paste isn't cut off as long as the
+// client is still reading it.
+func streamWriter(w http.ResponseWriter, r *http.Request) io.Writer {
+	rc, ok := r.Context().Value(controllerKey{}).(*http.ResponseController)
+	if !ok {
+		return w
+	}
+	return &deadlineWriter{w, rc}
+}
+
+type deadlineWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.rc.SetWriteDeadline(time.Now().Add(streamTimeout))
+	return d.w.Write(p)
+}
+
 func serveFile(filename string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, filename)
@@ -29,6 +74,14 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 	http.NotFound(w, r)
 }
 
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+}
+
+func gone(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "410 Gone", http.StatusGone)
+}
+
 func internalServerError(w http.ResponseWriter, err error) {
 	log.Printf("Err: %s\n", err)
 	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
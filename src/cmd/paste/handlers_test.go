@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadlines(t *testing.T) {
+	defer func(request, stream time.Duration) {
+		requestTimeout, streamTimeout = request, stream
+	}(requestTimeout, streamTimeout)
+	requestTimeout = time.Duration(200) * time.Millisecond
+	streamTimeout = time.Duration(200) * time.Millisecond
+
+	// each chunk is too big to buffer, so it goes straight to the connection
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+	const chunks = 10
+	slowly := func(w io.Writer) {
+		for i := 0; i < chunks; i++ {
+			time.Sleep(time.Duration(50) * time.Millisecond)
+			_, err := w.Write(chunk)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		slowly(streamWriter(w, r))
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		slowly(w)
+	})
+	srv := httptest.NewServer(withDeadlines(mux))
+	defer srv.Close()
+
+	tests := []struct {
+		path string
+		full bool
+	}{
+		{"/stream", true},
+		{"/plain", false},
+	}
+	for _, test := range tests {
+		res, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if full := len(body) == chunks*len(chunk); full != test.full {
+			t.Errorf("%s sent %d bytes, want all of them to be sent: %t", test.path, len(body), test.full)
+		}
+	}
+}
@@ -1,22 +1,190 @@
 package main
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chilts/sid"
 )
 
 const idChars string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-const idCharLen = len(idChars)
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+// These are the only chars allowed in a configured alphabet, since anything else either needs escaping in a URL or
+// means something to our routes (such as the "." in "/TtysPe.txt").
+const idAllowedChars string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_~"
+
+// ErrNoIdAvailable is returned if an allocator can't find an Id which isn't already taken.
+var ErrNoIdAvailable = errors.New("no id available")
+
+// IdAllocator hands out Ids for new pastes. The taken func reports whether an Id is already in use, and should be
+// called from within the same transaction which saves the paste, so that the Id is reserved by that transaction.
+type IdAllocator interface {
+	Allocate(taken func(id string) bool) (string, error)
+}
+
+// newIdAllocator returns the allocator for the scheme given, which is one of:
+//
+// * "random" (the default) - random chars from the alphabet given (or idChars), of the length given (or 6)
+// * "words" - random words from idWords joined with a "-", starting with the number of words given (or 3)
+// * "sid" - time sortable Ids from github.com/chilts/sid, so the paste bucket is in creation order
+func newIdAllocator(scheme, length, chars string) (IdAllocator, error) {
+	n := 0
+	if length != "" {
+		var err error
+		n, err = strconv.Atoi(length)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid id length %q", length)
+		}
+	}
+
+	switch scheme {
+	case "", "random":
+		if chars == "" {
+			chars = idChars
+		}
+		if len(chars) < 2 {
+			return nil, errors.New("id chars must contain at least two chars")
+		}
+		for i, c := range chars {
+			if !strings.ContainsRune(idAllowedChars, c) {
+				return nil, fmt.Errorf("id chars may only contain %q", idAllowedChars)
+			}
+			if strings.IndexRune(chars, c) != i {
+				return nil, fmt.Errorf("id chars contains %q more than once", c)
+			}
+		}
+		if n == 0 {
+			n = 6
+		}
+		return NewRandomIdAllocator(chars, n), nil
+	case "words":
+		if n == 0 {
+			n = 3
+		}
+		return NewWordIdAllocator(idWords, n), nil
+	case "sid":
+		return &SidIdAllocator{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown id scheme %q", scheme)
+}
+
+// RandomIdAllocator hands out random Ids made up of Len symbols joined with Sep. If it gets Attempts collisions in a
+// row then the keyspace must be filling up, so it grows the length of all Ids from then on (up to MaxLen).
+type RandomIdAllocator struct {
+	Symbols  []string
+	Sep      string
+	Attempts int
+	MaxLen   int
+	Rand     io.Reader
+
+	mu  sync.Mutex
+	len int
+}
+
+// NewRandomIdAllocator returns an allocator which starts with Ids of n chars, using crypto/rand.
+func NewRandomIdAllocator(chars string, n int) *RandomIdAllocator {
+	return &RandomIdAllocator{
+		Symbols:  strings.Split(chars, ""),
+		Sep:      "",
+		Attempts: 5,
+		MaxLen:   32,
+		Rand:     rand.Reader,
+		len:      n,
+	}
+}
+
+// NewWordIdAllocator returns an allocator which starts with Ids of n words such as "brave-otter-lamp", using
+// crypto/rand. These are easy to read out to someone.
+func NewWordIdAllocator(words []string, n int) *RandomIdAllocator {
+	return &RandomIdAllocator{
+		Symbols:  words,
+		Sep:      "-",
+		Attempts: 5,
+		MaxLen:   8,
+		Rand:     rand.Reader,
+		len:      n,
+	}
+}
+
+// Len returns the number of symbols in the Ids currently being handed out.
+func (a *RandomIdAllocator) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.len
+}
+
+// Allocate returns a new random Id for which taken returns false.
+func (a *RandomIdAllocator) Allocate(taken func(id string) bool) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.len <= a.MaxLen {
+		for i := 0; i < a.Attempts; i++ {
+			indexes, err := randomIndexes(a.Rand, len(a.Symbols), a.len)
+			if err != nil {
+				return "", err
+			}
+			parts := make([]string, len(indexes))
+			for j, index := range indexes {
+				parts[j] = a.Symbols[index]
+			}
+			id := strings.Join(parts, a.Sep)
+			if !taken(id) {
+				return id, nil
+			}
+		}
+
+		a.len++
+		log.Printf("Too many Id collisions, Ids are now %d long\n", a.len)
+	}
+
+	return "", ErrNoIdAvailable
+}
+
+// randomIndexes returns n random numbers from 0 to size-1 (where size is at most 256), reading random bytes from r.
+// Any bytes which would make some numbers more likely than others are discarded.
+func randomIndexes(r io.Reader, size int, n int) ([]int, error) {
+	max := 256 - (256 % size)
+
+	indexes := make([]int, 0, n)
+	buf := make([]byte, n)
+	for len(indexes) < n {
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range buf {
+			if int(b) >= max {
+				continue
+			}
+			indexes = append(indexes, int(b)%size)
+			if len(indexes) == n {
+				break
+			}
+		}
+	}
+
+	return indexes, nil
 }
 
-func Id(len int) string {
-	str := ""
-	for i := 0; i < len; i++ {
-		r := rand.Intn(idCharLen)
-		str = str + string(idChars[r])
+// SidIdAllocator hands out time sortable Ids such as "1IeSBAWW83j-2wgJ4PUtlAr". Since these sort by creation time, so
+// does the paste bucket.
+type SidIdAllocator struct{}
+
+// Allocate returns a new sid for which taken returns false. A collision is almost impossible, but we check anyway.
+func (a *SidIdAllocator) Allocate(taken func(id string) bool) (string, error) {
+	for i := 0; i < 5; i++ {
+		id := sid.Id()
+		if !taken(id) {
+			return id, nil
+		}
 	}
-	return str
+	return "", ErrNoIdAvailable
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRandomIdAllocator(t *testing.T) {
+	ids := NewRandomIdAllocator(idChars, 6)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := ids.Allocate(func(id string) bool { return seen[id] })
+		if err != nil {
+			t.Fatalf("Allocate() returned an error: %s", err)
+		}
+		if len(id) != 6 {
+			t.Fatalf("id %q should be 6 chars", id)
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(idChars, c) {
+				t.Fatalf("id %q contains a char not in idChars", id)
+			}
+		}
+		seen[id] = true
+	}
+}
+
+func TestRandomIdAllocatorRetriesOnCollision(t *testing.T) {
+	ids := NewRandomIdAllocator("ab", 2)
+
+	taken := map[string]bool{"aa": true, "ab": true, "ba": true}
+	id, err := ids.Allocate(func(id string) bool { return taken[id] })
+	if err != nil {
+		t.Fatalf("Allocate() returned an error: %s", err)
+	}
+	if taken[id] {
+		t.Fatalf("id %q was already taken", id)
+	}
+}
+
+func TestRandomIdAllocatorGrows(t *testing.T) {
+	ids := NewRandomIdAllocator("ab", 1)
+
+	// fill the keyspace for 1 char, so the next Id must be longer
+	taken := map[string]bool{"a": true, "b": true}
+	id, err := ids.Allocate(func(id string) bool { return taken[id] })
+	if err != nil {
+		t.Fatalf("Allocate() returned an error: %s", err)
+	}
+	if len(id) != 2 {
+		t.Fatalf("id %q should have grown to 2 chars", id)
+	}
+	if ids.Len() != 2 {
+		t.Fatalf("Len() should be 2, not %d", ids.Len())
+	}
+}
+
+func TestRandomIdAllocatorExhausted(t *testing.T) {
+	ids := NewRandomIdAllocator("ab", 1)
+	ids.MaxLen = 3
+
+	_, err := ids.Allocate(func(id string) bool { return true })
+	if err != ErrNoIdAvailable {
+		t.Fatalf("Allocate() should return ErrNoIdAvailable, not %v", err)
+	}
+}
+
+func TestRandomIndexesSkipsBiasedBytes(t *testing.T) {
+	// with 52 chars, bytes 208 and above would favour the first 48 chars so must be skipped (and 52 wraps to 0)
+	r := bytes.NewReader([]byte{208, 255, 0, 1, 51, 52, 0, 0})
+	indexes, err := randomIndexes(r, len(idChars), 4)
+	if err != nil {
+		t.Fatalf("randomIndexes() returned an error: %s", err)
+	}
+	if fmt.Sprint(indexes) != "[0 1 51 0]" {
+		t.Fatalf("randomIndexes() should be [0 1 51 0], not %v", indexes)
+	}
+}
+
+func TestWordIdAllocator(t *testing.T) {
+	ids := NewWordIdAllocator(idWords, 3)
+
+	id, err := ids.Allocate(func(id string) bool { return false })
+	if err != nil {
+		t.Fatalf("Allocate() returned an error: %s", err)
+	}
+	words := strings.Split(id, "-")
+	if len(words) != 3 {
+		t.Fatalf("id %q should be 3 words", id)
+	}
+	for _, word := range words {
+		found := false
+		for _, w := range idWords {
+			if w == word {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("id %q contains a word not in idWords", id)
+		}
+	}
+}
+
+func TestIdWords(t *testing.T) {
+	if len(idWords) != 256 {
+		t.Fatalf("there should be 256 idWords, not %d", len(idWords))
+	}
+	seen := make(map[string]bool)
+	for _, word := range idWords {
+		if seen[word] {
+			t.Fatalf("idWords contains %q more than once", word)
+		}
+		seen[word] = true
+	}
+}
+
+func TestSidIdAllocator(t *testing.T) {
+	ids := &SidIdAllocator{}
+
+	prev := ""
+	for i := 0; i < 100; i++ {
+		id, err := ids.Allocate(func(id string) bool { return false })
+		if err != nil {
+			t.Fatalf("Allocate() returned an error: %s", err)
+		}
+		if id <= prev {
+			t.Fatalf("id %q should sort after %q", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestNewIdAllocator(t *testing.T) {
+	valid := [][]string{
+		{"", "", ""},
+		{"random", "8", "abcdef0123456789"},
+		{"words", "4", ""},
+		{"sid", "", ""},
+	}
+	for _, config := range valid {
+		_, err := newIdAllocator(config[0], config[1], config[2])
+		if err != nil {
+			t.Errorf("newIdAllocator(%q) returned an error: %s", config, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"uuid", "", ""},
+		{"random", "0", ""},
+		{"random", "six", ""},
+		{"random", "", "a"},
+		{"random", "", "abca"},
+		{"random", "", "ab.c"},
+	}
+	for _, config := range invalid {
+		_, err := newIdAllocator(config[0], config[1], config[2])
+		if err == nil {
+			t.Errorf("newIdAllocator(%q) should have returned an error", config)
+		}
+	}
+}
+
+func TestCreateSkipsReservedIds(t *testing.T) {
+	// "s" is the /s/ route, so a 1 char Id has to grow
+	paste, err := NewMemStore().Create(Paste{}, []byte("hello"), NewRandomIdAllocator("s", 1))
+	if err != nil {
+		t.Fatalf("Create() returned an error: %s", err)
+	}
+	if paste.Id != "ss" {
+		t.Fatalf("id %q should have grown past the reserved one", paste.Id)
+	}
+
+	// but routes are matched exactly, so "S" is fine
+	paste, err = NewMemStore().Create(Paste{}, []byte("hello"), NewRandomIdAllocator("S", 1))
+	if err != nil {
+		t.Fatalf("Create() returned an error: %s", err)
+	}
+	if paste.Id != "S" {
+		t.Fatalf("id %q should have been S", paste.Id)
+	}
+}
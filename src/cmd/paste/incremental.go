@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// Incremental dumps only contain what has changed since the newest dump (full or incremental) in the dump dir. They
+// are named like full dumps but end with ".inc.tar.gz":
+//
+//     paste/TtysPe.3
+//     ...
+//     changes.jsonl
+//     MANIFEST
+//
+// Each line of changes.jsonl is either a paste which has been created or updated (with all of its revisions, so a
+// replay knows which files it should have) or the tombstone of a deleted paste. Only the files of new revisions are
+// included, since the older ones are in an earlier dump.
+const dumpChangesName = "changes.jsonl"
+
+// incrementalOverlap is how far before the last dump each incremental dump starts from. A paste's Created or Updated is
+// set just before it is committed, so this catches anything which was committed just after the last dump began.
+// Replaying a change twice is harmless.
+const incrementalOverlap = time.Duration(1) * time.Minute
+
+// Some writes keep the Created and Updated times they already had (an import, fsck repairs, a restore, moving an old
+// paste file into a blob), so an incremental dump wouldn't notice them. Each one records here when it happened, and
+// the next dump is a full one.
+var dumpBucketNameStr = "dump"
+var dumpBucketName = []byte(dumpBucketNameStr)
+
+const fullDumpKey = "full"
+
+// errFullDumpNeeded is returned by dumpIncremental when something has changed which only a full dump will pick up.
+var errFullDumpNeeded = errors.New("a full dump is needed")
+
+// dumpChange is one line of changes.jsonl.
+type dumpChange struct {
+	Paste     *Paste     `json:",omitempty"`
+	Revisions []Revision `json:",omitempty"`
+	Public    string     `json:",omitempty"`
+	Views     string     `json:",omitempty"`
+	Tombstone *tombstone `json:",omitempty"`
+}
+
+// isIncrementalDump says whether this is the filename of an incremental dump.
+func isIncrementalDump(name string) bool {
+	return strings.HasSuffix(name, ".inc.tar.gz")
+}
+
+// Call it with something like:
+//
+//     go dumpIncrementalEvery(ctx, store, time.Duration(15)*time.Minute, "/var/lib/project/dump", ret)
+//
+// alongside a less frequent dumpEvery, until ctx is done. When a full dump is needed, one is written (and the dumps
+// pruned to ret) instead.
+func dumpIncrementalEvery(ctx context.Context, s *BoltStore, d time.Duration, dir string, ret retention) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := dumpIncremental(s, dir)
+			if err == errFullDumpNeeded {
+				log.Println("Writing a full dump instead of an incremental one")
+				dumpAndPrune(s, dir, ret)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error writing incremental dump: %s\n", err)
+			}
+		}
+	}
+}
+
+// dumpIncremental writes everything which has changed since the last dump. Nothing is written until there has been a
+// full dump to build on, and if something has changed which only a full dump will pick up, it returns
+// errFullDumpNeeded.
+func dumpIncremental(s *BoltStore, dir string) error {
+	since, ok, err := lastDumpTime(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Println("No full dump yet, skipping the incremental dump")
+		return nil
+	}
+	full := false
+	err = s.db.View(func(tx *bolt.Tx) error {
+		_, full, err = fullDumpNeeded(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if full {
+		return errFullDumpNeeded
+	}
+	since = since.Add(-incrementalOverlap)
+
+	filename := path.Join(dir, time.Now().Format(dumpTimeFormat)+".inc.tar.gz")
+
+	s.startDump()
+	defer s.endDump()
+
+	// Find the changes first, then write the files once the transaction is closed, so that writes aren't held up
+	// whilst the files (or objects) are read. Only the text of new revisions kept in bolt is read up front.
+	type dumpFile struct {
+		id       string
+		revision Revision
+		gz       []byte
+	}
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	changes := 0
+	todo := make([]dumpFile, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				paste := Paste{}
+				err := json.Unmarshal(v, &paste)
+				if err != nil {
+					return err
+				}
+				// views aren't timestamped, so pastes with a view limit are always included in case theirs has changed
+				if !paste.Created.After(since) && !paste.Updated.After(since) && paste.MaxViews == 0 {
+					return nil
+				}
+
+				change := dumpChange{Paste: &paste}
+				change.Revisions, err = getRevisions(tx, paste)
+				if err != nil {
+					return err
+				}
+				change.Public, err = rod.GetString(tx, publicBucketNameStr, paste.Id)
+				if err != nil {
+					return err
+				}
+				change.Views, err = rod.GetString(tx, viewsBucketNameStr, paste.Id)
+				if err != nil {
+					return err
+				}
+
+				for _, revision := range change.Revisions {
+					if !revision.Created.After(since) || !dumpsText(paste) {
+						continue
+					}
+					var gz []byte
+					if revision.Hash != "" {
+						gz, err = getText(tx, revision.Hash)
+						if err != nil {
+							return err
+						}
+					}
+					todo = append(todo, dumpFile{paste.Id, revision, gz})
+				}
+
+				changes++
+				return enc.Encode(change)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = tx.Bucket(tombstoneBucketName)
+		if b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				ts := tombstone{}
+				err := json.Unmarshal(v, &ts)
+				if err != nil {
+					return err
+				}
+				if !ts.Deleted.After(since) {
+					return nil
+				}
+
+				changes++
+				return enc.Encode(dumpChange{Tombstone: &ts})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeDump(filename, func(tw *tar.Writer, manifest io.Writer) error {
+		for _, f := range todo {
+			err := dumpPasteFile(tw, manifest, s, f.id, f.revision, f.gz)
+			if err != nil {
+				return err
+			}
+		}
+		return writeDumpEntry(tw, manifest, dumpChangesName, int64(buf.Len()), time.Now(), buf.WriteTo)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Incremental dump written %d changes and %d paste files\n", changes, len(todo))
+	return nil
+}
+
+// needFullDump records that the next dump must be a full one.
+func needFullDump(tx *bolt.Tx) error {
+	return rod.PutString(tx, dumpBucketNameStr, fullDumpKey, time.Now().Format(time.RFC3339Nano))
+}
+
+// fullDumpNeeded says whether the next dump must be a full one, and since when.
+func fullDumpNeeded(tx *bolt.Tx) (time.Time, bool, error) {
+	str, err := rod.GetString(tx, dumpBucketNameStr, fullDumpKey)
+	if err != nil || str == "" {
+		return time.Time{}, false, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// fullDumpDone forgets that a full dump is needed, as long as nothing asked for one after a full dump started at t.
+func fullDumpDone(db *bolt.DB, t time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		since, full, err := fullDumpNeeded(tx)
+		if err != nil || !full || !since.Before(t) {
+			return err
+		}
+		return rod.Del(tx, dumpBucketNameStr, fullDumpKey)
+	})
+}
+
+// lastDumpTime returns when the newest dump (full or incremental) in dir was taken, or false if there is no full dump
+// at all.
+func lastDumpTime(dir string) (time.Time, bool, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var last time.Time
+	full := false
+	for _, name := range names {
+		t, ok := dumpTime(name)
+		if !ok {
+			continue
+		}
+		if !isIncrementalDump(name) {
+			full = true
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last, full, nil
+}
+
+// replayChanges applies the changes from an incremental dump to the datastore in filename, whose paste files are in
+// dir (flat, as they are in a dump). It returns how many revision files the changes refer to which aren't in dir,
+// which means an incremental dump has been missed.
+func replayChanges(filename, dir string, changes []dumpChange) (int, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	missing := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			var id string
+			switch {
+			case change.Paste != nil:
+				id = change.Paste.Id
+			case change.Tombstone != nil:
+				id = change.Tombstone.Id
+			default:
+				continue
+			}
+
+			// start again from nothing, since the Id may have been deleted and reused
+			for _, name := range []string{publicBucketNameStr, viewsBucketNameStr, pasteBucketNameStr} {
+				err := rod.Del(tx, name, id)
+				if err != nil {
+					return err
+				}
+			}
+			err := delRevisions(tx, id)
+			if err != nil {
+				return err
+			}
+			keep := make(map[string]bool)
+
+			if change.Paste != nil {
+				err := rod.PutJson(tx, pasteBucketNameStr, id, change.Paste)
+				if err != nil {
+					return err
+				}
+				if change.Public != "" {
+					err := rod.PutString(tx, publicBucketNameStr, id, change.Public)
+					if err != nil {
+						return err
+					}
+				}
+				if change.Views != "" {
+					err := rod.PutString(tx, viewsBucketNameStr, id, change.Views)
+					if err != nil {
+						return err
+					}
+				}
+				for _, revision := range change.Revisions {
+					err := putRevision(tx, id, revision)
+					if err != nil {
+						return err
+					}
+					filename := flatPasteFilename(dir, id, revision.Rev)
+					keep[filename] = true
+					if _, err := os.Stat(filename); os.IsNotExist(err) && dumpsText(*change.Paste) {
+						missing++
+					}
+				}
+			}
+
+			// and remove any files which are no longer part of this paste
+			filenames, err := filepath.Glob(flatPasteFilename(dir, id, 1) + ".*")
+			if err != nil {
+				return err
+			}
+			for _, filename := range append(filenames, flatPasteFilename(dir, id, 1)) {
+				if keep[filename] {
+					continue
+				}
+				err := os.Remove(filename)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return missing, err
+}
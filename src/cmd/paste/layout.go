@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PASTE_DIR is sharded on the first four characters of each Id, two per level, so that no one dir gets too big:
+//
+//     Tt/ys/TtysPe
+//     Tt/ys/TtysPe.2
+//     my/-s/my-slug
+//
+// Pastes used to all be in PASTE_DIR itself. Those are still read from there until `paste migrate-layout` moves them.
+
+// pasteBasename returns the name of the file for this revision. The first revision is just the paste's Id (which is
+// how pastes have always been stored) and each later revision gets the revision number as a suffix, e.g. "TtysPe",
+// "TtysPe.2", "TtysPe.3".
+func pasteBasename(id string, rev int) string {
+	if rev <= 1 {
+		return id
+	}
+	return id + "." + strconv.Itoa(rev)
+}
+
+// pasteShard returns the dirs (within PASTE_DIR) which the files for this paste are in. Ids shorter than four
+// characters are padded with "_".
+func pasteShard(id string) string {
+	padded := id + "____"
+	return padded[0:2] + "/" + padded[2:4]
+}
+
+// pasteFilename returns where the text for this revision lives.
+func pasteFilename(dir, id string, rev int) string {
+	return dir + "/" + pasteShard(id) + "/" + pasteBasename(id, rev)
+}
+
+// flatPasteFilename returns where the text for this revision lived before PASTE_DIR was sharded.
+func flatPasteFilename(dir, id string, rev int) string {
+	return dir + "/" + pasteBasename(id, rev)
+}
+
+// openPasteFile opens the text for this revision from wherever it is. The sharded layout is checked again if it isn't
+// in the flat layout either, in case `paste migrate-layout` moved it in between.
+func openPasteFile(dir, id string, rev int) (*os.File, error) {
+	f, err := os.Open(pasteFilename(dir, id, rev))
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	f, err = os.Open(flatPasteFilename(dir, id, rev))
+	if !os.IsNotExist(err) {
+		return f, err
+	}
+	return os.Open(pasteFilename(dir, id, rev))
+}
+
+// makeParentDirs makes sure the shard dirs for filename exist. Any new dirs are synced into their parents so that a
+// file written into them survives a crash.
+func makeParentDirs(filename string) error {
+	shard := filepath.Dir(filename)
+	if _, err := os.Stat(shard); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(shard, 0755)
+	if err != nil {
+		return err
+	}
+	err = syncDir(filepath.Dir(shard))
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filepath.Dir(shard)))
+}
+
+// removePasteFiles removes the files for every revision of this paste, from both layouts. The flat layout goes first
+// so that a file being moved by `paste migrate-layout` is found in one place or the other. Only revision files (and
+// their temporary files) are matched, since other things in PASTE_DIR can start with the same name, such as
+// "blobs.sha256".
+func removePasteFiles(dir, id string) error {
+	for _, first := range []string{flatPasteFilename(dir, id, 1), pasteFilename(dir, id, 1)} {
+		filenames, err := filepath.Glob(first + ".[0-9]*")
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, first, first+".tmp")
+
+		for _, filename := range filenames {
+			info, err := os.Lstat(filename)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				continue
+			}
+			err = os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLayoutCmd is the `paste migrate-layout` command, which moves every paste file still in the top of PASTE_DIR
+// into its shard. Files are only ever renamed (and can be read from either place) so it is safe to run whilst the
+// server is running.
+func migrateLayoutCmd(args []string) error {
+	flags := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	flags.Parse(args)
+
+	dir := os.Getenv("PASTE_DIR")
+	if dir == "" {
+		return errors.New("Specify the dir pastefiles are in with 'PASTE_DIR'")
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	moved, skipped := 0, 0
+	for {
+		names, err := d.Readdirnames(1000)
+		for _, name := range names {
+			// unfinished writes are left for the server to recover
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+
+			filename := filepath.Join(dir, name)
+			info, err := os.Lstat(filename)
+			if os.IsNotExist(err) {
+				// deleted in the meantime
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				// including the shard dirs themselves
+				continue
+			}
+
+			id, rev, _ := parsePasteFilename(name)
+			target := pasteFilename(dir, id, rev)
+			if _, err := os.Stat(target); err == nil {
+				fmt.Printf("%s is already in %s, skipping (run `paste fsck` with the server stopped)\n", name, pasteShard(id))
+				skipped++
+				continue
+			}
+
+			err = makeParentDirs(target)
+			if err != nil {
+				return err
+			}
+			err = os.Rename(filename, target)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			moved++
+			if moved%10000 == 0 {
+				fmt.Printf("Moved %d paste files so far\n", moved)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = syncDir(dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved %d paste files into shards, %d skipped\n", moved, skipped)
+	return nil
+}
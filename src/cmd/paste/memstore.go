@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStore keeps everything in memory. It is useful for tests, or when nothing needs to survive a restart.
+type MemStore struct {
+	mu        sync.Mutex
+	pastes    map[string]Paste
+	revisions map[string][]Revision
+	texts     map[string][][]byte
+	views     map[string]int
+}
+
+// Make sure MemStore implements Store.
+var _ Store = &MemStore{}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		pastes:    make(map[string]Paste),
+		revisions: make(map[string][]Revision),
+		texts:     make(map[string][][]byte),
+		views:     make(map[string]int),
+	}
+}
+
+func (s *MemStore) Create(paste Paste, text []byte, ids IdAllocator) (Paste, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := ids.Allocate(func(id string) bool {
+		_, ok := s.pastes[id]
+		return ok || isReserved(id)
+	})
+	if err != nil {
+		return paste, err
+	}
+	paste.Id = id
+
+	s.pastes[id] = paste
+	revision := Revision{Rev: paste.LatestRevision(), Size: paste.Size, Hash: hashText(text), Created: paste.Created}
+	s.revisions[id] = []Revision{revision}
+	s.texts[id] = [][]byte{append([]byte{}, text...)}
+	return paste, nil
+}
+
+func (s *MemStore) Get(id string) (Paste, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paste, ok := s.pastes[id]
+	if !ok {
+		return paste, ErrNotFound
+	}
+	return paste, nil
+}
+
+func (s *MemStore) Open(id string, rev int) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	texts, ok := s.texts[id]
+	if !ok || rev < 1 || rev > len(texts) {
+		return nil, ErrNotFound
+	}
+	// texts are never changed once saved, so we don't need a copy
+	return ioutil.NopCloser(bytes.NewReader(texts[rev-1])), nil
+}
+
+func (s *MemStore) Revisions(id string) ([]Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revisions, ok := s.revisions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Revision{}, revisions...), nil
+}
+
+func (s *MemStore) Revise(id, title string, text []byte) (Paste, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paste, ok := s.pastes[id]
+	if !ok {
+		return paste, ErrNotFound
+	}
+
+	now := time.Now().UTC()
+	revision := Revision{
+		Rev:     paste.LatestRevision() + 1,
+		Size:    len(text),
+		Hash:    hashText(text),
+		Created: now,
+	}
+	s.revisions[id] = append(s.revisions[id], revision)
+	s.texts[id] = append(s.texts[id], append([]byte{}, text...))
+
+	paste.Title = title
+	paste.Size = revision.Size
+	paste.Revision = revision.Rev
+	paste.Updated = now
+	s.pastes[id] = paste
+	return paste, nil
+}
+
+func (s *MemStore) View(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paste, ok := s.pastes[id]
+	if !ok {
+		return false, nil
+	}
+	if paste.MaxViews > 0 && s.views[id] >= paste.MaxViews {
+		return false, nil
+	}
+	s.views[id]++
+	return true, nil
+}
+
+func (s *MemStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pastes[id]; !ok {
+		return false, nil
+	}
+	delete(s.pastes, id)
+	delete(s.revisions, id)
+	delete(s.texts, id)
+	delete(s.views, id)
+	return true, nil
+}
+
+func (s *MemStore) ListPublic(fn func(id string) error) error {
+	for _, paste := range s.sorted() {
+		if paste.Visibility != "public" {
+			continue
+		}
+		err := fn(paste.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Iterate(fn func(paste Paste) error) error {
+	for _, paste := range s.sorted() {
+		err := fn(paste)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Import(paste Paste, revisions []Revision, texts [][]byte) error {
+	err := checkImport(paste, revisions, texts)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pastes[paste.Id]; ok {
+		return ErrExists
+	}
+
+	s.pastes[paste.Id] = paste
+	s.revisions[paste.Id] = append([]Revision{}, revisions...)
+	s.texts[paste.Id] = make([][]byte, len(texts))
+	for i, text := range texts {
+		s.revisions[paste.Id][i].Hash = hashText(text)
+		s.texts[paste.Id][i] = append([]byte{}, text...)
+	}
+	return nil
+}
+
+func (s *MemStore) PublicExists(hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, revisions := range s.revisions {
+		if s.pastes[id].Visibility != "public" {
+			continue
+		}
+		for _, revision := range revisions {
+			if revision.Hash == hash {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sorted returns a copy of all pastes in Id order, the same order as the BoltStore.
+func (s *MemStore) sorted() []Paste {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pastes := make([]Paste, 0, len(s.pastes))
+	for _, paste := range s.pastes {
+		pastes = append(pastes, paste)
+	}
+	sort.Slice(pastes, func(i, j int) bool { return pastes[i].Id < pastes[j].Id })
+	return pastes
+}
@@ -0,0 +1,13 @@
+// +build !sqlite
+
+package main
+
+import "errors"
+
+// errNoSQLite is returned by everything which needs SQLiteStore, which is only built with `-tags sqlite` (see
+// sqlitestore.go).
+var errNoSQLite = errors.New("this paste was built without SQLite, rebuild it with `make build-sqlite` to use it")
+
+func migrateSQLiteCmd(args []string) error {
+	return errNoSQLite
+}
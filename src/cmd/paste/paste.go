@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
@@ -9,21 +10,19 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/chilts/rod"
 	"github.com/gomiddleware/logger"
 	"github.com/gomiddleware/logit"
 	"github.com/gomiddleware/mux"
 )
 
-var pasteBucketNameStr = "paste"
-var pasteBucketName = []byte(pasteBucketNameStr)
-var publicBucketNameStr = "public"
-var publicBucketName = []byte(publicBucketNameStr)
-
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -31,6 +30,29 @@ func check(err error) {
 }
 
 func main() {
+	// run a command instead of the server, e.g. `paste fsck`
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			check(fsck(os.Args[2:]))
+		case "restore":
+			check(restore(os.Args[2:]))
+		case "verify-dump":
+			check(verifyDumpCmd(os.Args[2:]))
+		case "export":
+			check(exportCmd(os.Args[2:]))
+		case "import":
+			check(importCmd(os.Args[2:]))
+		case "migrate-layout":
+			check(migrateLayoutCmd(os.Args[2:]))
+		case "migrate-sqlite":
+			check(migrateSQLiteCmd(os.Args[2:]))
+		default:
+			log.Fatalf("Unknown command '%s'", os.Args[1])
+		}
+		return
+	}
+
 	// setup the logger
 	lgr := logit.New(os.Stdout, "paste")
 
@@ -49,7 +71,42 @@ func main() {
 	if dumpDir == "" {
 		log.Fatal("Specify a dir to write dumpfiles to 'PASTE_DUMP_DIR'")
 	}
+	dumpInterval := time.Duration(15) * time.Minute
+	if str := os.Getenv("PASTE_DUMP_INTERVAL"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid 'PASTE_DUMP_INTERVAL' %q, use a duration such as '15m' or '1h'", str)
+		}
+		dumpInterval = d
+	}
+	var incrementalInterval time.Duration
+	if str := os.Getenv("PASTE_INCREMENTAL_INTERVAL"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid 'PASTE_INCREMENTAL_INTERVAL' %q, use a duration such as '15m' or '1h'", str)
+		}
+		incrementalInterval = d
+	}
+	dumpRetention := defaultRetention
+	if str := os.Getenv("PASTE_DUMP_KEEP"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid 'PASTE_DUMP_KEEP' %q, use the number of recent dumps to keep", str)
+		}
+		dumpRetention.Recent = n
+	}
+	storage := os.Getenv("PASTE_STORAGE")
+	if storage != "" && storage != "files" && storage != "bolt" && storage != "s3" {
+		log.Fatalf("Invalid 'PASTE_STORAGE' %q, use 'files', 'bolt' or 's3'", storage)
+	}
+	objects, err := newS3ClientFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
 	googleAnalytics := os.Getenv("PASTE_GOOGLE_ANALYTICS")
+	idScheme := os.Getenv("PASTE_ID_SCHEME")
+	idLength := os.Getenv("PASTE_ID_LENGTH")
+	idAlphabet := os.Getenv("PASTE_ID_CHARS")
 
 	// load up all templates
 	tmpl, err := template.New("").ParseGlob("./templates/*.html")
@@ -60,25 +117,112 @@ func main() {
 	check(err)
 	defer db.Close()
 
-	// create the main buckets
-	err = db.Update(func(tx *bolt.Tx) error {
-		var err error
+	// everything goes through the store, which keeps the metadata in the datastore and the text in dir (or wherever
+	// PASTE_STORAGE says)
+	store, err := NewBoltStore(db, dir)
+	check(err)
+	store.inBolt = storage == "bolt"
+	store.objects = objects
 
-		_, err = tx.CreateBucketIfNotExists(pasteBucketName)
-		if err != nil {
-			return err
-		}
+	// clean up anything half finished from last time
+	recovered, err := store.Recover()
+	check(err)
+	if recovered > 0 {
+		log.Printf("Recovered %d unfinished write(s)\n", recovered)
+	}
 
-		return nil
-	})
+	// the background jobs run until ctx is cancelled at shutdown, and wg tells us when they've all stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	background := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+
+	// dump the DB every so often, pruning old dumps as we go
+	background(func() { dumpEvery(ctx, store, dumpInterval, dumpDir, dumpRetention) })
+
+	// and if asked, write incremental dumps in between
+	if incrementalInterval > 0 {
+		background(func() { dumpIncrementalEvery(ctx, store, incrementalInterval, dumpDir, dumpRetention) })
+	}
+
+	// remove expired pastes every minute
+	background(func() { reapEvery(ctx, store, time.Duration(1)*time.Minute) })
+
+	// compress any paste files which aren't already, now and then every hour
+	background(func() { compressEvery(ctx, store, time.Duration(1)*time.Hour) })
+
+	// decide how new pastes get their Ids
+	ids, err := newIdAllocator(idScheme, idLength, idAlphabet)
+	check(err)
+
+	// all the routes
+	cfg := config{Apex: apex, BaseUrl: baseUrl, GoogleAnalytics: googleAnalytics}
+	m, err := newMux(store, ids, tmpl, cfg, lgr)
 	check(err)
 
-	// dump the DB every 15 mins
-	go dumpEvery(db, time.Duration(15)*time.Minute, dumpDir)
+	// server
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           m,
+		ReadHeaderTimeout: time.Duration(10) * time.Second,
+		IdleTimeout:       time.Duration(120) * time.Second,
+	}
+	errServer := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting server, listening on port %s\n", port)
+		errServer <- server.ListenAndServe()
+	}()
+
+	// run until Ctrl-C or a SIGTERM from the supervisor
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errServer:
+		check(err)
+	case sig := <-sigs:
+		log.Printf("Received %s, shutting down\n", sig)
+	}
+
+	// stop taking new requests, and give the ones in flight a while to finish
+	ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(30)*time.Second)
+	defer cancelShutdown()
+	err = server.Shutdown(ctxShutdown)
+	if err != nil {
+		log.Printf("Error draining connections: %s\n", err)
+	}
+
+	// stop the background jobs, letting any which are part way through finish
+	cancel()
+	wg.Wait()
+
+	// and leave a dump of exactly what we stopped with
+	log.Println("Writing a final dump")
+	dumpAndPrune(store, dumpDir, dumpRetention)
+
+	log.Println("Stopped")
+}
+
+// config is the part of the environment which the handlers use.
+type config struct {
+	Apex            string
+	BaseUrl         string
+	GoogleAnalytics string
+}
+
+// newMux returns the mux with every route of the site, serving pastes from store. New pastes get their Ids from ids,
+// and every request is logged to lgr.
+func newMux(store Store, ids IdAllocator, tmpl *template.Template, cfg config, lgr *logit.Logger) (*mux.Mux, error) {
+	apex, baseUrl, googleAnalytics := cfg.Apex, cfg.BaseUrl, cfg.GoogleAnalytics
 
-	// the mux
 	m := mux.New()
 
+	m.Use("/", withDeadlines)
 	m.Use("/", logger.NewLogger(lgr))
 
 	// do some static routes before doing logging
@@ -88,21 +232,11 @@ func main() {
 
 	m.Get("/sitemap.txt", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintf(w, baseUrl+"/\n")
+		fmt.Fprintf(w, "%s/\n", baseUrl)
 
 		// let's get all of the public paste keys only
-		err := db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket(publicBucketName)
-			if b == nil {
-				// weird ... !
-				return nil
-			}
-
-			c := b.Cursor()
-			for k, _ := c.First(); k != nil; k, _ = c.Next() {
-				fmt.Fprintf(w, "%s/%s\n", baseUrl, k)
-			}
-
+		err := store.ListPublic(func(id string) error {
+			fmt.Fprintf(w, "%s/%s\n", baseUrl, id)
 			return nil
 		})
 		if err != nil {
@@ -150,6 +284,28 @@ func main() {
 		render(w, tmpl, "about.html", data)
 	})
 
+	// lets a client check whether some text has already been pasted publicly without sending it
+	m.Get("/hash/:hash", func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.ToLower(mux.Vals(r)["hash"])
+		if !isHash(hash) {
+			notFound(w, r)
+			return
+		}
+
+		ok, err := store.PublicExists(hash)
+		if err != nil {
+			internalServerError(w, err)
+			return
+		}
+		if !ok {
+			notFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s\n", hash)
+	})
+
 	m.Get("/paste", redirect("/"))
 	m.Post("/paste", func(w http.ResponseWriter, r *http.Request) {
 		// get the values of certain fields
@@ -161,15 +317,32 @@ func main() {
 			internalServerError(w, errors.New("visibility was not an allowed option"))
 			return
 		}
+		burn := r.FormValue("Burn")
+		if burn != "" && burn != "yes" {
+			internalServerError(w, errors.New("burn was not an allowed option"))
+			return
+		}
+		expire := r.FormValue("Expire")
+		expireDuration, ok := expireDurations[expire]
+		if !ok {
+			// again, this comes from a form
+			internalServerError(w, errors.New("expire was not an allowed option"))
+			return
+		}
 
-		// check that the paste is not empty
-		if text == "" {
+		maxViewsStr := strings.TrimSpace(r.FormValue("MaxViews"))
+		slug := strings.TrimSpace(r.FormValue("Slug"))
+
+		// if anything isn't right, show the form again with the errors
+		renderForm := func(errors map[string]string) {
 			form := make(map[string]string)
 			form["Title"] = title
 			form["Text"] = text
 			form["Visibility"] = visibility
-			errors := make(map[string]string)
-			errors["Text"] = "Provide some text"
+			form["Expire"] = expire
+			form["Burn"] = burn
+			form["MaxViews"] = maxViewsStr
+			form["Slug"] = slug
 			data := struct {
 				PageName        string
 				Apex            string
@@ -188,92 +361,238 @@ func main() {
 				errors,
 			}
 			render(w, tmpl, "index.html", data)
+		}
+
+		// check that the paste is not empty, that any view limit makes sense, and that any slug is allowed
+		errors := make(map[string]string)
+		if text == "" {
+			errors["Text"] = "Provide some text"
+		}
+		if slug != "" {
+			if msg := checkSlug(slug); msg != "" {
+				errors["Slug"] = msg
+			}
+		}
+		maxViews := 0
+		if maxViewsStr != "" {
+			n, err := strconv.Atoi(maxViewsStr)
+			if err != nil || n < 1 {
+				errors["MaxViews"] = "Provide a number of views, or leave it blank for no limit"
+			}
+			maxViews = n
+		}
+		if len(errors) > 0 {
+			renderForm(errors)
+			return
+		}
+
+		// the delete and edit tokens are only ever shown to the creator, we just keep the hashes
+		deleteToken, deleteHash, err := newToken()
+		if err != nil {
+			internalServerError(w, err)
+			return
+		}
+		editToken, editHash, err := newToken()
+		if err != nil {
+			internalServerError(w, err)
 			return
 		}
 
 		// create the paste
 		now := time.Now().UTC()
 		paste := Paste{
-			Id:         Id(6),
 			Title:      title,
 			Size:       len(text),
 			Visibility: visibility,
+			Burn:       burn == "yes",
+			MaxViews:   maxViews,
+			DeleteHash: deleteHash,
+			EditHash:   editHash,
+			Revision:   1,
 			Created:    now,
 			Updated:    now,
 		}
+		if expireDuration != 0 {
+			paste.Expire = now.Add(expireDuration)
+		}
 
-		// save the text to a file
-		filename := dir + "/" + paste.Id
-		err = ioutil.WriteFile(filename, []byte(text), 0755)
+		// save it, with either the slug asked for or a new Id
+		var allocator IdAllocator = ids
+		if slug != "" {
+			allocator = slugIdAllocator(slug)
+		}
+		paste, err = store.Create(paste, []byte(text), allocator)
+		if err == errSlugTaken {
+			renderForm(map[string]string{"Slug": "This name is already taken"})
+			return
+		}
 		if err != nil {
 			internalServerError(w, err)
 			return
 		}
 
-		// save this to the datastore
-		err = db.Update(func(tx *bolt.Tx) error {
-			// check if this is a public paste and add the name to the public bucket
-			if paste.Visibility == "public" {
-				rod.PutString(tx, publicBucketNameStr, paste.Id, now.Format("20060201-150405.000000000"))
-			}
+		// Tell the creator where the paste is and what the tokens are, since this is the only time they'll see it.
+		// (This also means burn after reading pastes aren't viewed by being redirected to them.)
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			DeleteToken     string
+			EditToken       string
+		}{
+			"created",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			deleteToken,
+			editToken,
+		}
+		render(w, tmpl, "created.html", data)
+	})
 
-			return rod.PutJson(tx, pasteBucketNameStr, paste.Id, paste)
-		})
+	// getPaste gets the paste info from the store, sending a 404 if it doesn't exist or a 410 if it has expired (the
+	// reaper may not have removed it yet). It returns false if a response has already been sent.
+	getPaste := func(w http.ResponseWriter, r *http.Request, id string) (Paste, bool) {
+		paste, err := store.Get(id)
+		if err == ErrNotFound {
+			notFound(w, r)
+			return paste, false
+		}
 		if err != nil {
 			internalServerError(w, err)
-			return
+			return paste, false
 		}
 
-		// fmt.Printf("--> redirecting\n")
-		http.Redirect(w, r, "/"+paste.Id, http.StatusFound)
-	})
+		if paste.HasExpired(time.Now().UTC()) {
+			gone(w, r)
+			return paste, false
+		}
 
-	m.Get("/:id", func(w http.ResponseWriter, r *http.Request) {
-		id := mux.Vals(r)["id"]
-		// fmt.Printf("id=%s\n", id)
+		return paste, true
+	}
 
-		// See if this is for the paste page `/TtysPe` or the raw paste `/TtysPe.txt`.
-		raw := strings.HasSuffix(id, ".txt")
-		if raw {
-			// remove the trailing ".txt" if this is a raw URL
-			id = strings.TrimSuffix(id, ".txt")
+	// viewPaste counts this view of a paste with a view limit, sending a 410 once the limit has been reached. It
+	// returns false if a response has already been sent.
+	viewPaste := func(w http.ResponseWriter, r *http.Request, paste Paste) bool {
+		if paste.MaxViews == 0 {
+			return true
 		}
 
-		// get the paste info from the datastore
-		paste := Paste{}
-		err := db.View(func(tx *bolt.Tx) error {
-			return rod.GetJson(tx, pasteBucketNameStr, id, &paste)
-		})
+		viewed, err := store.View(paste.Id)
 		if err != nil {
 			internalServerError(w, err)
-			return
+			return false
+		}
+		if !viewed {
+			gone(w, r)
+			return false
 		}
 
-		// ToDo: check to see if this paste has expired
-		if paste.Expire.IsZero() {
-			// no expiry set
-		} else {
-			// check paste.Expire
+		return true
+	}
+
+	// Burn after reading pastes show this page first, which POSTs back to the same URL to actually view the paste. This
+	// stops link previews (which only GET) from using up the one and only view.
+	confirmBurn := func(w http.ResponseWriter, r *http.Request, paste Paste) {
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			Action          string
+		}{
+			"burn",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			r.URL.Path,
+		}
+		render(w, tmpl, "burn.html", data)
+	}
+
+	// openPaste gets the paste and opens the latest revision for the routes which serve it. Burn after reading pastes
+	// are confirmed and then deleted, and views are counted for pastes with a view limit. If redirect, clients are sent
+	// to fetch the text from object storage themselves (saving it as filename, unless that's "") when they can. It
+	// returns false if a response has already been sent, otherwise the caller should close the text once done.
+	openPaste := func(w http.ResponseWriter, r *http.Request, id string, redirect bool,
+		filename string) (Paste, io.ReadCloser, bool) {
+		paste, ok := getPaste(w, r, id)
+		if !ok {
+			return paste, nil, false
 		}
 
-		// check if the file exists (even though it should)
-		filename := dir + "/" + id
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
+		// decide from the paste alone, before the text is opened (but never for pastes which can only be seen so many
+		// times, since the URL could be used again)
+		if redirect && !paste.Burn && paste.MaxViews == 0 && redirectText(w, r, store, paste, filename) {
+			return paste, nil, false
+		}
+
+		// open the text (even though it should exist)
+		text, err := store.Open(id, paste.LatestRevision())
+		if err == ErrNotFound {
 			notFound(w, r)
-			return
+			return paste, nil, false
+		}
+		if err != nil {
+			internalServerError(w, err)
+			return paste, nil, false
 		}
 
-		if raw {
-			// open the file
-			file, err := os.Open(filename)
+		// burn after reading pastes must be confirmed first, then are removed prior to being served
+		if paste.Burn {
+			if r.Method != "POST" {
+				text.Close()
+				confirmBurn(w, r, paste)
+				return paste, nil, false
+			}
+			burnt, err := store.Delete(id)
 			if err != nil {
+				text.Close()
 				internalServerError(w, err)
-				return
+				return paste, nil, false
 			}
+			if !burnt {
+				// someone else got here first
+				text.Close()
+				notFound(w, r)
+				return paste, nil, false
+			}
+		}
+
+		// pastes with a view limit need this view counted, and become gone once the limit is reached
+		if !viewPaste(w, r, paste) {
+			text.Close()
+			return paste, nil, false
+		}
+
+		return paste, text, true
+	}
 
+	pasteHandler := func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+
+		// See if this is for the paste page `/TtysPe` or the raw paste `/TtysPe.txt`.
+		raw := strings.HasSuffix(id, ".txt")
+		if raw {
+			// remove the trailing ".txt" if this is a raw URL
+			id = strings.TrimSuffix(id, ".txt")
+		}
+
+		paste, file, ok := openPaste(w, r, id, raw, "")
+		if !ok {
+			return
+		}
+		defer file.Close()
+
+		if raw {
 			// write the plaintext header and stream the file
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			_, err = io.Copy(w, file)
+			err := sendText(w, r, file)
 			if err != nil {
 				internalServerError(w, err)
 				return
@@ -282,7 +601,7 @@ func main() {
 		}
 
 		// rendering the paste page, so we're going to read in the file in it's entirety
-		text, err := ioutil.ReadFile(filename)
+		text, err := ioutil.ReadAll(file)
 		if err != nil {
 			internalServerError(w, err)
 			return
@@ -305,47 +624,42 @@ func main() {
 			string(text),
 		}
 		render(w, tmpl, "paste.html", data)
-	})
+	}
+	m.Get("/:id", pasteHandler)
+	m.Post("/:id", pasteHandler)
 
-	m.Get("/dl/:id", func(w http.ResponseWriter, r *http.Request) {
+	downloadHandler := func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vals(r)["id"]
 
-		// check if the file exists (even though it should)
-		filename := dir + "/" + id
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			notFound(w, r)
-			return
-		}
-
-		// open the file
-		file, err := os.Open(filename)
-		if err != nil {
-			internalServerError(w, err)
+		_, file, ok := openPaste(w, r, id, true, id+".txt")
+		if !ok {
 			return
 		}
+		defer file.Close()
 
 		// write the plaintext header and stream the file
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Header().Set("Content-Disposition", "attachment; filename="+id+".txt")
-		_, err = io.Copy(w, file)
+		err := sendText(w, r, file)
 		if err != nil {
 			internalServerError(w, err)
 			return
 		}
-	})
+	}
+	m.Get("/dl/:id", downloadHandler)
+	m.Post("/dl/:id", downloadHandler)
 
-	m.Get("/iframe/:id", func(w http.ResponseWriter, r *http.Request) {
+	iframeHandler := func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vals(r)["id"]
 
-		// check if the file exists (even though it should)
-		filename := dir + "/" + id
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			notFound(w, r)
+		_, file, ok := openPaste(w, r, id, false, "")
+		if !ok {
 			return
 		}
+		defer file.Close()
 
 		// rendering the paste page, so we're going to read in the file in it's entirety
-		text, err := ioutil.ReadFile(filename)
+		text, err := ioutil.ReadAll(file)
 		if err != nil {
 			internalServerError(w, err)
 			return
@@ -366,13 +680,404 @@ func main() {
 			string(text),
 		}
 		render(w, tmpl, "iframe.html", data)
+	}
+	m.Get("/iframe/:id", iframeHandler)
+	m.Post("/iframe/:id", iframeHandler)
+
+	editHandler := func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+
+		paste, ok := getPaste(w, r, id)
+		if !ok {
+			return
+		}
+		if paste.Burn {
+			// burn after reading pastes only ever have the one view, so editing them makes no sense
+			forbidden(w, r)
+			return
+		}
+
+		form := make(map[string]string)
+		errors := make(map[string]string)
+		if r.Method == "POST" {
+			form["Title"] = r.FormValue("Title")
+			form["Text"] = r.FormValue("Text")
+			if form["Text"] == "" {
+				errors["Text"] = "Provide some text"
+			} else if !checkToken(paste.EditHash, strings.TrimSpace(r.FormValue("Token"))) {
+				errors["Token"] = "Incorrect edit token"
+			} else {
+				_, err := store.Revise(id, form["Title"], []byte(form["Text"]))
+				if err == ErrNotFound {
+					notFound(w, r)
+					return
+				}
+				if err != nil {
+					internalServerError(w, err)
+					return
+				}
+				http.Redirect(w, r, "/"+id, http.StatusFound)
+				return
+			}
+		} else {
+			form["Title"] = paste.Title
+			// pastes with a view limit don't show their text here, otherwise anyone could read them without it counting
+			if paste.MaxViews == 0 {
+				file, err := store.Open(id, paste.LatestRevision())
+				if err != nil {
+					internalServerError(w, err)
+					return
+				}
+				text, err := ioutil.ReadAll(file)
+				file.Close()
+				if err != nil {
+					internalServerError(w, err)
+					return
+				}
+				form["Text"] = string(text)
+			}
+		}
+
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			Form            map[string]string
+			Errors          map[string]string
+		}{
+			"edit",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			form,
+			errors,
+		}
+		render(w, tmpl, "edit.html", data)
+	}
+	m.Get("/:id/edit", editHandler)
+	m.Post("/:id/edit", editHandler)
+
+	// getRevisions gets all revisions of the paste, sending a 404 for burn after reading pastes since those only ever
+	// have the one view. It returns false if a response has already been sent.
+	getRevisions := func(w http.ResponseWriter, r *http.Request, paste Paste) ([]Revision, bool) {
+		if paste.Burn {
+			notFound(w, r)
+			return nil, false
+		}
+
+		revisions, err := store.Revisions(paste.Id)
+		if err == ErrNotFound {
+			notFound(w, r)
+			return nil, false
+		}
+		if err != nil {
+			internalServerError(w, err)
+			return nil, false
+		}
+
+		return revisions, true
+	}
+
+	// findRevision returns the revision numbered rev from revisions, or a zero Revision if there isn't one.
+	findRevision := func(revisions []Revision, rev int) Revision {
+		for _, revision := range revisions {
+			if revision.Rev == rev {
+				return revision
+			}
+		}
+		return Revision{}
+	}
+
+	// readRevision reads in the text of this revision in it's entirety. It returns false if a response has already
+	// been sent.
+	readRevision := func(w http.ResponseWriter, r *http.Request, id string, rev int) ([]byte, bool) {
+		file, err := store.Open(id, rev)
+		if err == ErrNotFound {
+			notFound(w, r)
+			return nil, false
+		}
+		if err != nil {
+			internalServerError(w, err)
+			return nil, false
+		}
+		defer file.Close()
+
+		text, err := ioutil.ReadAll(file)
+		if err != nil {
+			internalServerError(w, err)
+			return nil, false
+		}
+		return text, true
+	}
+
+	m.Get("/:id/history", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+
+		paste, ok := getPaste(w, r, id)
+		if !ok {
+			return
+		}
+		revisions, ok := getRevisions(w, r, paste)
+		if !ok {
+			return
+		}
+
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			Revisions       []Revision
+		}{
+			"history",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			revisions,
+		}
+		render(w, tmpl, "history.html", data)
 	})
 
-	// finally, check all routing was added correctly
-	check(m.Err)
+	m.Get("/:id/r/:rev", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+		revStr := mux.Vals(r)["rev"]
 
-	// server
-	fmt.Printf("Starting server, listening on port %s\n", port)
-	errServer := http.ListenAndServe(":"+port, m)
-	check(errServer)
+		// just like the paste page, `/TtysPe/r/2` is the page and `/TtysPe/r/2.txt` is the raw revision
+		raw := strings.HasSuffix(revStr, ".txt")
+		if raw {
+			revStr = strings.TrimSuffix(revStr, ".txt")
+		}
+		rev, err := strconv.Atoi(revStr)
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+
+		paste, ok := getPaste(w, r, id)
+		if !ok {
+			return
+		}
+		revisions, ok := getRevisions(w, r, paste)
+		if !ok {
+			return
+		}
+		revision := findRevision(revisions, rev)
+		if revision.Rev == 0 {
+			notFound(w, r)
+			return
+		}
+
+		text, ok := readRevision(w, r, id, rev)
+		if !ok {
+			return
+		}
+
+		// older revisions count towards the view limit too
+		if !viewPaste(w, r, paste) {
+			return
+		}
+
+		if raw {
+			// write the plaintext header and the text
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(text)
+			return
+		}
+
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			Revision        Revision
+			Text            string
+		}{
+			"revision",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			revision,
+			string(text),
+		}
+		render(w, tmpl, "revision.html", data)
+	})
+
+	m.Get("/:id/diff/:a/:b", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+		aStr := mux.Vals(r)["a"]
+		bStr := mux.Vals(r)["b"]
+
+		// See if this is for the diff page `/TtysPe/diff/1/2` or the raw unified diff `/TtysPe/diff/1/2.diff`.
+		raw := strings.HasSuffix(bStr, ".diff")
+		if raw {
+			bStr = strings.TrimSuffix(bStr, ".diff")
+		}
+		a, err := strconv.Atoi(aStr)
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+		b, err := strconv.Atoi(bStr)
+		if err != nil {
+			notFound(w, r)
+			return
+		}
+
+		paste, ok := getPaste(w, r, id)
+		if !ok {
+			return
+		}
+		revisions, ok := getRevisions(w, r, paste)
+		if !ok {
+			return
+		}
+		revA := findRevision(revisions, a)
+		revB := findRevision(revisions, b)
+		if revA.Rev == 0 || revB.Rev == 0 {
+			notFound(w, r)
+			return
+		}
+
+		// read both revisions in their entirety
+		textA, ok := readRevision(w, r, id, a)
+		if !ok {
+			return
+		}
+		textB, ok := readRevision(w, r, id, b)
+		if !ok {
+			return
+		}
+
+		// diffs show the text, so count towards the view limit too
+		if !viewPaste(w, r, paste) {
+			return
+		}
+
+		hunks := diffHunks(diffLines(splitLines(string(textA)), splitLines(string(textB))), diffContext)
+
+		if raw {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			err = writeUnifiedDiff(w, "/"+id+"/r/"+aStr, "/"+id+"/r/"+bStr, hunks)
+			if err != nil {
+				internalServerError(w, err)
+				return
+			}
+			return
+		}
+
+		// render the Diff page, either unified (the default) or side-by-side
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			A               Revision
+			B               Revision
+			Hunks           []DiffHunk
+			Split           bool
+		}{
+			"diff",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			revA,
+			revB,
+			hunks,
+			r.FormValue("view") == "split",
+		}
+		render(w, tmpl, "diff.html", data)
+	})
+
+	m.Delete("/:id", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+
+		// the token can be given in a header or as a query param
+		token := r.Header.Get("X-Delete-Token")
+		if token == "" {
+			token = r.FormValue("Token")
+		}
+
+		paste, err := store.Get(id)
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, err)
+			return
+		}
+		if !checkToken(paste.DeleteHash, token) {
+			forbidden(w, r)
+			return
+		}
+
+		_, err = store.Delete(id)
+		if err != nil {
+			internalServerError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	deleteFormHandler := func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vals(r)["id"]
+
+		paste, err := store.Get(id)
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		if err != nil {
+			internalServerError(w, err)
+			return
+		}
+
+		errors := make(map[string]string)
+		deleted := false
+		if r.Method == "POST" {
+			if checkToken(paste.DeleteHash, strings.TrimSpace(r.FormValue("Token"))) {
+				_, err = store.Delete(id)
+				if err != nil {
+					internalServerError(w, err)
+					return
+				}
+				deleted = true
+			} else {
+				errors["Token"] = "Incorrect delete token"
+			}
+		}
+
+		data := struct {
+			PageName        string
+			Apex            string
+			BaseUrl         string
+			GoogleAnalytics string
+			Paste           Paste
+			Deleted         bool
+			Errors          map[string]string
+		}{
+			"delete",
+			apex,
+			baseUrl,
+			googleAnalytics,
+			paste,
+			deleted,
+			errors,
+		}
+		render(w, tmpl, "delete.html", data)
+	}
+	m.Get("/:id/delete", deleteFormHandler)
+	m.Post("/:id/delete", deleteFormHandler)
+
+	return m, m.Err
 }
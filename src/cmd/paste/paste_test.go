@@ -0,0 +1,281 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomiddleware/logit"
+)
+
+// newTestServer serves every route from a MemStore, with the real templates.
+func newTestServer(t *testing.T) (*httptest.Server, *MemStore) {
+	store := NewMemStore()
+	return newStoreServer(t, store), store
+}
+
+// newStoreServer serves every route from store, with the real templates.
+func newStoreServer(t *testing.T, store Store) *httptest.Server {
+	tmpl, err := template.New("").ParseGlob("../../../templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{Apex: "paste.test", BaseUrl: "http://paste.test"}
+	m, err := newMux(store, NewRandomIdAllocator(idChars, 6), tmpl, cfg, logit.New(ioutil.Discard, "paste"))
+	if err != nil {
+		t.Fatalf("newMux() returned an error: %s", err)
+	}
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, u string) (int, string) {
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("GET %s returned an error: %s", u, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading GET %s returned an error: %s", u, err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// del sends a DELETE with the token in the X-Delete-Token header.
+func del(t *testing.T, u, token string) int {
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Delete-Token", token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE %s returned an error: %s", u, err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func post(t *testing.T, u string, form url.Values) (int, string) {
+	res, err := http.PostForm(u, form)
+	if err != nil {
+		t.Fatalf("POST %s returned an error: %s", u, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading POST %s returned an error: %s", u, err)
+	}
+	return res.StatusCode, string(body)
+}
+
+var createdRegexp = regexp.MustCompile(
+	`id="(link|delete-token|edit-token)" readonly class="form-control" value="([^"]*)"`)
+
+// createPasteForm posts the paste form with the text and any other fields, returning the new paste's Id and the delete
+// and edit tokens shown to its creator.
+func createPasteForm(t *testing.T, srv *httptest.Server, text string, fields ...string) (string, string, string) {
+	form := url.Values{}
+	form.Set("Text", text)
+	form.Set("Visibility", "unlisted")
+	form.Set("Expire", "1h")
+	for i := 0; i+1 < len(fields); i += 2 {
+		form.Set(fields[i], fields[i+1])
+	}
+	status, body := post(t, srv.URL+"/paste", form)
+	if status != http.StatusOK {
+		t.Fatalf("POST /paste returned %d:\n%s", status, body)
+	}
+
+	values := make(map[string]string)
+	for _, match := range createdRegexp.FindAllStringSubmatch(body, -1) {
+		values[match[1]] = match[2]
+	}
+	if !strings.HasPrefix(values["link"], "http://paste.test/") {
+		t.Fatalf("POST /paste didn't create a paste:\n%s", body)
+	}
+	return strings.TrimPrefix(values["link"], "http://paste.test/"), values["delete-token"], values["edit-token"]
+}
+
+func TestCreateViewExpire(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	if id, _, _ := createPasteForm(t, srv, "hello\nworld\n", "Slug", "my-paste"); id != "my-paste" {
+		t.Fatalf("paste was created as %s, not my-paste", id)
+	}
+
+	status, text := get(t, srv.URL+"/my-paste.txt")
+	if status != http.StatusOK || text != "hello\nworld\n" {
+		t.Fatalf("GET /my-paste.txt returned %d %q", status, text)
+	}
+	if status, _ := get(t, srv.URL+"/my-paste"); status != http.StatusOK {
+		t.Fatalf("GET /my-paste returned %d", status)
+	}
+
+	// once it has expired it's gone, even before the reaper removes it
+	store.mu.Lock()
+	paste := store.pastes["my-paste"]
+	paste.Expire = time.Now().UTC().Add(-time.Minute)
+	store.pastes["my-paste"] = paste
+	store.mu.Unlock()
+	for _, path := range []string{"/my-paste", "/my-paste.txt"} {
+		if status, _ := get(t, srv.URL+path); status != http.StatusGone {
+			t.Fatalf("GET %s returned %d after expiring, not 410", path, status)
+		}
+	}
+
+	if status, _ := get(t, srv.URL+"/nothing-here"); status != http.StatusNotFound {
+		t.Fatalf("GET /nothing-here returned %d, not 404", status)
+	}
+}
+
+func TestBurnAfterReading(t *testing.T) {
+	srv, _ := newTestServer(t)
+	id, _, editToken := createPasteForm(t, srv, "secret", "Burn", "yes")
+	if editToken != "" {
+		t.Fatalf("burn after reading paste was given an edit token")
+	}
+
+	// just looking (e.g. a link preview) only gets the confirmation page
+	for i := 0; i < 2; i++ {
+		status, body := get(t, srv.URL+"/"+id)
+		if status != http.StatusOK || strings.Contains(body, "secret") || !strings.Contains(body, "Burn after reading") {
+			t.Fatalf("GET /%s returned %d:\n%s", id, status, body)
+		}
+	}
+
+	// the confirmed view gets the text, once
+	status, body := post(t, srv.URL+"/"+id+".txt", url.Values{})
+	if status != http.StatusOK || body != "secret" {
+		t.Fatalf("POST /%s.txt returned %d %q", id, status, body)
+	}
+	for _, path := range []string{"/" + id, "/" + id + ".txt", "/dl/" + id} {
+		if status, _ := post(t, srv.URL+path, url.Values{}); status != http.StatusNotFound {
+			t.Fatalf("POST %s returned %d after it was read, not 404", path, status)
+		}
+	}
+}
+
+func TestMaxViews(t *testing.T) {
+	srv, _ := newTestServer(t)
+	id, _, _ := createPasteForm(t, srv, "twice", "MaxViews", "2")
+
+	// every route which shows the text counts as a view
+	if status, text := get(t, srv.URL+"/"+id+".txt"); status != http.StatusOK || text != "twice" {
+		t.Fatalf("GET /%s.txt returned %d %q", id, status, text)
+	}
+	if status, _ := get(t, srv.URL+"/iframe/"+id); status != http.StatusOK {
+		t.Fatalf("GET /iframe/%s returned %d", id, status)
+	}
+
+	// and once they're used up it's gone everywhere
+	for _, path := range []string{"/" + id, "/" + id + ".txt", "/dl/" + id, "/iframe/" + id, "/" + id + "/r/1"} {
+		if status, _ := get(t, srv.URL+path); status != http.StatusGone {
+			t.Fatalf("GET %s returned %d after 2 views, not 410", path, status)
+		}
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	srv, _ := newTestServer(t)
+	a, deleteToken, _ := createPasteForm(t, srv, "hello")
+	_, otherToken, _ := createPasteForm(t, srv, "world")
+
+	// the wrong token (even one for another paste) is refused, and the paste is still there
+	for _, token := range []string{"", "nonsense", otherToken} {
+		if status := del(t, srv.URL+"/"+a, token); status != http.StatusForbidden {
+			t.Fatalf("DELETE /%s with token %q returned %d, not 403", a, token, status)
+		}
+	}
+	if status, _ := get(t, srv.URL+"/"+a+".txt"); status != http.StatusOK {
+		t.Fatalf("GET /%s.txt returned %d after a refused delete", a, status)
+	}
+
+	// the right one deletes it
+	if status := del(t, srv.URL+"/"+a, deleteToken); status != http.StatusNoContent {
+		t.Fatalf("DELETE /%s returned %d, not 204", a, status)
+	}
+	if status, _ := get(t, srv.URL+"/"+a+".txt"); status != http.StatusNotFound {
+		t.Fatalf("GET /%s.txt returned %d after it was deleted, not 404", a, status)
+	}
+	if status := del(t, srv.URL+"/"+a, deleteToken); status != http.StatusNotFound {
+		t.Fatalf("DELETE /%s returned %d once it had gone, not 404", a, status)
+	}
+
+	// and so does the form
+	b, deleteToken, _ := createPasteForm(t, srv, "again")
+	status, body := post(t, srv.URL+"/"+b+"/delete", url.Values{"Token": {otherToken}})
+	if status != http.StatusOK || !strings.Contains(body, "Incorrect delete token") {
+		t.Fatalf("POST /%s/delete with the wrong token returned %d:\n%s", b, status, body)
+	}
+	status, body = post(t, srv.URL+"/"+b+"/delete", url.Values{"Token": {deleteToken}})
+	if status != http.StatusOK || !strings.Contains(body, "This paste has been deleted") {
+		t.Fatalf("POST /%s/delete returned %d:\n%s", b, status, body)
+	}
+	if status, _ := get(t, srv.URL+"/"+b); status != http.StatusNotFound {
+		t.Fatalf("GET /%s returned %d after it was deleted, not 404", b, status)
+	}
+}
+
+func TestEditHistory(t *testing.T) {
+	srv, _ := newTestServer(t)
+	id, _, editToken := createPasteForm(t, srv, "first\n")
+
+	status, body := post(t, srv.URL+"/"+id+"/edit", url.Values{"Text": {"second\n"}, "Token": {"nonsense"}})
+	if status != http.StatusOK || !strings.Contains(body, "Incorrect edit token") {
+		t.Fatalf("POST /%s/edit with the wrong token returned %d:\n%s", id, status, body)
+	}
+
+	// the edit redirects back to the paste, which is now the new revision
+	status, body = post(t, srv.URL+"/"+id+"/edit", url.Values{"Text": {"second\n"}, "Token": {editToken}})
+	if status != http.StatusOK || !strings.Contains(body, "second") {
+		t.Fatalf("POST /%s/edit returned %d:\n%s", id, status, body)
+	}
+	if status, text := get(t, srv.URL+"/"+id+".txt"); status != http.StatusOK || text != "second\n" {
+		t.Fatalf("GET /%s.txt returned %d %q", id, status, text)
+	}
+
+	// and the history has both
+	status, body = get(t, srv.URL+"/"+id+"/history")
+	if status != http.StatusOK {
+		t.Fatalf("GET /%s/history returned %d", id, status)
+	}
+	for _, link := range []string{"/" + id + "/r/1", "/" + id + "/r/2", "/" + id + "/diff/1/2"} {
+		if !strings.Contains(body, `href="`+link+`"`) {
+			t.Fatalf("GET /%s/history has no link to %s:\n%s", id, link, body)
+		}
+	}
+	if status, text := get(t, srv.URL+"/"+id+"/r/1.txt"); status != http.StatusOK || text != "first\n" {
+		t.Fatalf("GET /%s/r/1.txt returned %d %q", id, status, text)
+	}
+	want := "--- /" + id + "/r/1\n+++ /" + id + "/r/2\n@@ -1 +1 @@\n-first\n+second\n"
+	if status, diff := get(t, srv.URL+"/"+id+"/diff/1/2.diff"); status != http.StatusOK || diff != want {
+		t.Fatalf("GET /%s/diff/1/2.diff returned %d %q", id, status, diff)
+	}
+}
+
+func TestReservedSlugs(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	form := url.Values{"Text": {"hello"}, "Visibility": {"unlisted"}, "Expire": {"1h"}, "Slug": {"about"}}
+	status, body := post(t, srv.URL+"/paste", form)
+	if status != http.StatusOK || !strings.Contains(body, "This name is reserved") {
+		t.Fatalf("POST /paste with slug about returned %d:\n%s", status, body)
+	}
+
+	// routes are matched exactly, so a slug which only differs in case is still served
+	if id, _, _ := createPasteForm(t, srv, "hello", "Slug", "About"); id != "About" {
+		t.Fatalf("paste was created as %s, not About", id)
+	}
+	if status, text := get(t, srv.URL+"/About.txt"); status != http.StatusOK || text != "hello" {
+		t.Fatalf("GET /About.txt returned %d %q", status, text)
+	}
+}
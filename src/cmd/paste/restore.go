@@ -0,0 +1,363 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// restore is the `paste restore <archive>` command. It rebuilds paste.db and PASTE_DIR (or the bucket, with
+// PASTE_STORAGE=s3) from a dump, checking every checksum before anything is moved into place. An existing datastore is
+// only overwritten with -force, and never while the server has it open.
+//
+// Any incremental dumps given after the full dump are replayed over it, in order.
+//
+// Old style `.db.gz` dumps (from before dumps included paste files) can also be restored, though they have no paste
+// files or checksums.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite an existing datastore")
+	dbFilename := flags.String("db", "paste.db", "the datastore to restore to")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return errors.New("Usage: paste restore [-force] [-db paste.db] <archive> [incremental...]")
+	}
+	archive := flags.Arg(0)
+	incrementals := flags.Args()[1:]
+
+	// incrementals only make sense replayed over an earlier full dump, one after the other
+	if isIncrementalDump(archive) {
+		return fmt.Errorf("%s is an incremental dump, restore a full dump first", archive)
+	}
+	last, _ := dumpTime(filepath.Base(archive))
+	for _, inc := range incrementals {
+		if !isIncrementalDump(inc) {
+			return fmt.Errorf("%s is not an incremental dump", inc)
+		}
+		t, ok := dumpTime(filepath.Base(inc))
+		if !ok || t.Before(last) {
+			return fmt.Errorf("%s is out of order, incremental dumps must come after the full dump in the order taken", inc)
+		}
+		last = t
+	}
+
+	dir := os.Getenv("PASTE_DIR")
+	if dir == "" {
+		return errors.New("Specify the dir to restore pastefiles to with 'PASTE_DIR'")
+	}
+	objects, err := newS3ClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	// never touch a datastore which is there already, unless told to, and never one which is in use
+	if _, err := os.Stat(*dbFilename); err == nil {
+		if !*force {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", *dbFilename)
+		}
+		db, err := bolt.Open(*dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+		if err != nil {
+			return fmt.Errorf("%s is in use (is the server still running?): %s", *dbFilename, err)
+		}
+		db.Close()
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// everything is written somewhere temporary first, and only moved into place once it has all been checked
+	dbTmp := *dbFilename + ".restore"
+	defer os.Remove(dbTmp)
+	staging, err := ioutil.TempDir(dir, ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if strings.HasSuffix(archive, ".db.gz") {
+		fmt.Printf("%s is an old style dump, it has no paste files or checksums\n", archive)
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		err = writeFileFrom(dbTmp, zr)
+		if err != nil {
+			return err
+		}
+	} else {
+		haveDb := false
+		err = readDump(f, func(name string, r io.Reader) error {
+			if name == dumpDbName {
+				haveDb = true
+				return writeFileFrom(dbTmp, r)
+			}
+			if name == dumpChangesName {
+				return errors.New("this is an incremental dump")
+			}
+			return writeFileFrom(filepath.Join(staging, filepath.Base(name)), r)
+		})
+		if err == nil && !haveDb {
+			err = fmt.Errorf("no %s in dump", dumpDbName)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", archive, err)
+		}
+	}
+
+	// replay each incremental dump over the top
+	for _, inc := range incrementals {
+		changes, err := readIncremental(inc, staging)
+		if err != nil {
+			return fmt.Errorf("%s: %s", inc, err)
+		}
+		missing, err := replayChanges(dbTmp, staging, changes)
+		if err != nil {
+			return fmt.Errorf("%s: %s", inc, err)
+		}
+		fmt.Printf("Replayed %d changes from %s\n", len(changes), inc)
+		if missing > 0 {
+			fmt.Printf("%d paste files are missing, has an incremental dump been left out?\n", missing)
+		}
+	}
+	if len(incrementals) == 0 {
+		if n := newerIncrementals(archive); n > 0 {
+			fmt.Printf("There are %d incremental dumps newer than %s, give them after it to replay them too\n", n, archive)
+		}
+	}
+
+	// make sure the DB is usable, and count what's in it
+	pastes, public, err := countPastes(dbTmp)
+	if err != nil {
+		return fmt.Errorf("%s: %s", archive, err)
+	}
+
+	// the files go first, so if we stop part way through there are only some extra files for `paste fsck` to find
+	files, err := placeRestoredFiles(dbTmp, staging, dir, objects)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(dbTmp, *dbFilename)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s with %d pastes (%d public) and %d paste files to %s\n",
+		*dbFilename, pastes, public, files, dir)
+	if *force {
+		fmt.Println("Run `paste fsck` to check for any files left over from before the restore")
+	}
+	return nil
+}
+
+// placeRestoredFiles moves each revision's file from staging into dir, as a blob if the revision has a hash (where
+// revisions sharing a blob only need one of their files) or as its own file if not. Revisions whose text is kept in
+// the DB don't need a file. If there are objects, blobs are saved in object storage instead of dir. The blob references
+// are recounted first, since the replayed changes don't keep them. It returns how many files were moved.
+func placeRestoredFiles(dbFilename, staging, dir string, objects *s3Client) (int, error) {
+	db, err := bolt.Open(dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	store := &BoltStore{db: db, dir: dir, objects: objects}
+
+	files := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		refs, err := countBlobRefs(tx)
+		if err != nil {
+			return err
+		}
+		err = indexPublicBlobs(tx)
+		if err != nil {
+			return err
+		}
+
+		// text kept in the DB may belong to pastes the incrementals deleted
+		_, err = pruneText(tx, refs)
+		if err != nil {
+			return err
+		}
+		// the dumps already in the dump dir may be newer than the one restored, so start again with a full dump
+		err = needFullDump(tx)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(pasteBucketName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			paste := Paste{}
+			err := json.Unmarshal(v, &paste)
+			if err != nil {
+				return err
+			}
+			revisions, err := getRevisions(tx, paste)
+			if err != nil {
+				return err
+			}
+			for _, revision := range revisions {
+				staged := filepath.Join(staging, pasteBasename(paste.Id, revision.Rev))
+				if _, err := os.Stat(staged); os.IsNotExist(err) {
+					continue
+				}
+
+				if revision.Hash != "" && hasText(tx, revision.Hash) {
+					// already in the DB
+					continue
+				}
+				if revision.Hash != "" && objects != nil {
+					text, err := ioutil.ReadFile(staged)
+					if err != nil {
+						return err
+					}
+					gz, err := gzipText(text)
+					if err != nil {
+						return err
+					}
+					written, err := store.putObject(revision.Hash, gz)
+					if err != nil {
+						return err
+					}
+					if written {
+						files++
+					}
+					continue
+				}
+				filename := pasteFilename(dir, paste.Id, revision.Rev)
+				if revision.Hash != "" {
+					filename = blobFilename(dir, revision.Hash)
+					if _, err := os.Stat(filename); err == nil {
+						// already there from another revision
+						continue
+					}
+				}
+				err := makeParentDirs(filename)
+				if err != nil {
+					return err
+				}
+				err = os.Rename(staged, filename)
+				if err != nil {
+					return err
+				}
+				files++
+			}
+			return nil
+		})
+	})
+	return files, err
+}
+
+// readIncremental reads the changes from an incremental dump, writing its paste files into dir.
+func readIncremental(filename, dir string) ([]dumpChange, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	changes := make([]dumpChange, 0)
+	haveChanges := false
+	err = readDump(f, func(name string, r io.Reader) error {
+		switch name {
+		case dumpDbName:
+			return errors.New("this is a full dump")
+		case dumpChangesName:
+			haveChanges = true
+			dec := json.NewDecoder(r)
+			for {
+				change := dumpChange{}
+				err := dec.Decode(&change)
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				changes = append(changes, change)
+			}
+		default:
+			return writeFileFrom(filepath.Join(dir, filepath.Base(name)), r)
+		}
+	})
+	if err == nil && !haveChanges {
+		err = fmt.Errorf("no %s in dump", dumpChangesName)
+	}
+	return changes, err
+}
+
+// newerIncrementals counts the incremental dumps next to this dump which were taken after it.
+func newerIncrementals(filename string) int {
+	t, ok := dumpTime(filepath.Base(filename))
+	if !ok {
+		return 0
+	}
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(filename), "*.inc.tar.gz"))
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, name := range names {
+		if it, ok := dumpTime(filepath.Base(name)); ok && it.After(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// countPastes opens the datastore read-only and counts all and public pastes.
+func countPastes(filename string) (int, int, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	pastes, public := 0, 0
+	err = db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(pasteBucketName); b != nil {
+			pastes = b.Stats().KeyN
+		}
+		if b := tx.Bucket(publicBucketName); b != nil {
+			public = b.Stats().KeyN
+		}
+		return nil
+	})
+	return pastes, public, err
+}
+
+// writeFileFrom copies everything from r into filename and syncs it.
+func writeFileFrom(filename string, r io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// createPasteAt creates a paste as if it had been created at t.
+func createPasteAt(t *testing.T, store *BoltStore, text string, at time.Time) Paste {
+	paste := Paste{Visibility: "public", Size: len(text), Revision: 1, Created: at, Updated: at}
+	paste, err := store.Create(paste, []byte(text), NewRandomIdAllocator(idChars, 6))
+	if err != nil {
+		t.Fatalf("Create() returned an error: %s", err)
+	}
+	return paste
+}
+
+// renameDump renames the dump which fn writes to dir so that it looks like it was taken at t, returning its new name.
+func renameDump(t *testing.T, dir string, at time.Time, ext string, fn func() error) string {
+	before, _ := filepath.Glob(filepath.Join(dir, "*"))
+	err := fn()
+	if err != nil {
+		t.Fatalf("dumping returned an error: %s", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(after) != len(before)+1 {
+		t.Fatalf("dumping wrote %v", after)
+	}
+	for _, name := range after {
+		if !contains(before, name) {
+			renamed := filepath.Join(dir, at.Format(dumpTimeFormat)+ext)
+			err := os.Rename(name, renamed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return renamed
+		}
+	}
+	return ""
+}
+
+func TestRestoreIncrementals(t *testing.T) {
+	store, dumpDir := newBoltStore(t)
+
+	// the full dump, with pastes from long before it
+	base := time.Now().Add(-time.Hour)
+	a := createPasteAt(t, store, "apple", base.Add(-time.Hour))
+	b := createPasteAt(t, store, "banana", base.Add(-time.Hour))
+	c := createPasteAt(t, store, "cherry", base.Add(-time.Hour))
+	full := renameDump(t, dumpDir, base, ".tar.gz", func() error {
+		_, err := dump(store, dumpDir)
+		return err
+	})
+
+	// then an edit, a delete and a new paste
+	_, err := store.Revise(a.Id, "", []byte("apple pie"))
+	if err != nil {
+		t.Fatalf("Revise() returned an error: %s", err)
+	}
+	_, err = store.Delete(b.Id)
+	if err != nil {
+		t.Fatalf("Delete() returned an error: %s", err)
+	}
+	d := createPaste(t, store, "date")
+	inc1 := renameDump(t, dumpDir, base.Add(time.Second), ".inc.tar.gz", func() error {
+		return dumpIncremental(store, dumpDir)
+	})
+
+	// and the new paste deleted again, and another created
+	_, err = store.Delete(d.Id)
+	if err != nil {
+		t.Fatalf("Delete() returned an error: %s", err)
+	}
+	e := createPaste(t, store, "elderberry")
+	inc2 := renameDump(t, dumpDir, base.Add(2*time.Second), ".inc.tar.gz", func() error {
+		return dumpIncremental(store, dumpDir)
+	})
+
+	// restore them all somewhere new
+	dir := filepath.Join(filepath.Dir(dumpDir), "restored")
+	dbFilename := filepath.Join(filepath.Dir(dumpDir), "restored.db")
+	t.Setenv("PASTE_DIR", dir)
+	err = restore([]string{"-db", dbFilename, full, inc1, inc2})
+	if err != nil {
+		t.Fatalf("restore() returned an error: %s", err)
+	}
+
+	db, err := bolt.Open(dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewBoltStore(db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{b.Id, d.Id} {
+		if _, err := restored.Get(id); err != ErrNotFound {
+			t.Errorf("deleted paste %s was restored", id)
+		}
+	}
+	want := map[string][]string{a.Id: {"apple", "apple pie"}, c.Id: {"cherry"}, e.Id: {"elderberry"}}
+	for id, texts := range want {
+		paste, err := restored.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s) returned an error: %s", id, err)
+		}
+		if paste.LatestRevision() != len(texts) {
+			t.Fatalf("paste %s was restored at revision %d, not %d", id, paste.LatestRevision(), len(texts))
+		}
+		for i, text := range texts {
+			got, err := readText(restored, id, i+1)
+			if err != nil || string(got) != text {
+				t.Fatalf("revision %d of %s was restored as %q (%v), not %q", i+1, id, got, err, text)
+			}
+		}
+	}
+	db.Close()
+
+	// and there's nothing left over
+	err = fsck([]string{"-db", dbFilename})
+	if err != nil {
+		t.Fatalf("fsck() of the restore returned an error: %s", err)
+	}
+}
+
+func TestImportNeedsFullDump(t *testing.T) {
+	store, dumpDir := newBoltStore(t)
+
+	base := time.Now().Add(-time.Hour)
+	createPasteAt(t, store, "apple", base.Add(-time.Hour))
+	renameDump(t, dumpDir, base, ".tar.gz", func() error {
+		_, err := dump(store, dumpDir)
+		return err
+	})
+
+	// an imported paste keeps its times from long before the last dump
+	old := base.Add(-24 * time.Hour)
+	text := []byte("banana")
+	paste := Paste{Id: "banana", Visibility: "unlisted", Size: len(text), Revision: 1, Created: old, Updated: old}
+	err := store.Import(paste, []Revision{{Rev: 1, Size: len(text), Created: old}}, [][]byte{text})
+	if err != nil {
+		t.Fatalf("Import() returned an error: %s", err)
+	}
+	err = dumpIncremental(store, dumpDir)
+	if err != errFullDumpNeeded {
+		t.Fatalf("dumpIncremental() after an import returned %v, want %v", err, errFullDumpNeeded)
+	}
+
+	// and once there has been a full dump, incremental dumps carry on
+	dumpAndPrune(store, dumpDir, defaultRetention)
+	full, _ := filepath.Glob(filepath.Join(dumpDir, "*[0-9].tar.gz"))
+	if len(full) != 2 {
+		t.Fatalf("dumpAndPrune() left full dumps %v, want 2", full)
+	}
+	err = dumpIncremental(store, dumpDir)
+	if err != nil {
+		t.Fatalf("dumpIncremental() after a full dump returned an error: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dumpTimeFormat is how each dump is named, e.g. "20170329-095936.tar.gz".
+const dumpTimeFormat = "20060102-150405"
+
+// retention is a grandfather-father-son policy for dumps. The Recent newest dumps are always kept, then the newest dump
+// of each day for the last Daily days (today included), then the newest dump of each ISO week for the last Weekly
+// weeks (this week included). Everything else is pruned.
+type retention struct {
+	Recent int
+	Daily  int
+	Weekly int
+}
+
+// defaultRetention keeps 2 hours of dumps (at every 15 mins), daily dumps for a week and weekly dumps for a month.
+var defaultRetention = retention{
+	Recent: 8,
+	Daily:  7,
+	Weekly: 5,
+}
+
+// staleDumpAge is how long a dump's temporary file is left before it is assumed to be from a dump which never finished.
+const staleDumpAge = time.Duration(1) * time.Hour
+
+// dumpTime returns when the dump with this filename was taken, or false if it isn't a (finished) dump.
+func dumpTime(name string) (time.Time, bool) {
+	var stamp string
+	switch {
+	case isIncrementalDump(name):
+		stamp = strings.TrimSuffix(name, ".inc.tar.gz")
+	case strings.HasSuffix(name, ".tar.gz"):
+		stamp = strings.TrimSuffix(name, ".tar.gz")
+	case strings.HasSuffix(name, ".db.gz"):
+		// dumps from before they included paste files
+		stamp = strings.TrimSuffix(name, ".db.gz")
+	default:
+		return time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation(dumpTimeFormat, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// prune returns the dumps in names which this policy doesn't keep. Anything which isn't a dump is left alone.
+// Incremental dumps are kept as long as they are newer than the oldest full dump which is kept, since they are only
+// useful replayed over one.
+func (ret retention) prune(names []string, now time.Time) []string {
+	type dumpFile struct {
+		name string
+		t    time.Time
+	}
+
+	dumps := make([]dumpFile, 0, len(names))
+	incrementals := make([]dumpFile, 0)
+	for _, name := range names {
+		t, ok := dumpTime(name)
+		if !ok {
+			continue
+		}
+		if isIncrementalDump(name) {
+			incrementals = append(incrementals, dumpFile{name, t})
+		} else {
+			dumps = append(dumps, dumpFile{name, t})
+		}
+	}
+
+	// newest first, so the first one seen in each day or week is the one to keep
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].t.After(dumps[j].t)
+	})
+
+	// the start of the first day and week which are kept, counting today and this week (from Monday) as the first
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	firstDay := today.AddDate(0, 0, 1-ret.Daily)
+	thisWeek := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	firstWeek := thisWeek.AddDate(0, 0, 7-7*ret.Weekly)
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	pruned := make([]string, 0)
+	var oldest time.Time
+	for i, dump := range dumps {
+		day := dump.t.Format("20060102")
+		year, week := dump.t.ISOWeek()
+		wk := fmt.Sprintf("%d-%02d", year, week)
+
+		keep := i < ret.Recent
+		keep = keep || ret.Daily > 0 && !days[day] && !dump.t.Before(firstDay)
+		keep = keep || ret.Weekly > 0 && !weeks[wk] && !dump.t.Before(firstWeek)
+		if !keep {
+			pruned = append(pruned, dump.name)
+			continue
+		}
+
+		// whatever it was kept for, it also counts as the newest of its day and week
+		days[day] = true
+		weeks[wk] = true
+		oldest = dump.t
+	}
+
+	for _, inc := range incrementals {
+		if inc.t.Before(oldest) {
+			pruned = append(pruned, inc.name)
+		}
+	}
+	return pruned
+}
+
+// pruneDumps removes every dump in dir which the policy doesn't keep, logging each one.
+func pruneDumps(dir string, ret retention) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		names = append(names, info.Name())
+
+		// a dump which was interrupted (e.g. by a crash) leaves a temporary file behind
+		if strings.HasSuffix(info.Name(), ".tmp") && time.Since(info.ModTime()) > staleDumpAge {
+			log.Printf("Removing unfinished dump %s\n", info.Name())
+			err := os.Remove(path.Join(dir, info.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range ret.prune(names, time.Now()) {
+		log.Printf("Pruning old dump %s\n", name)
+		err := os.Remove(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetentionPrune(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name   string
+		ret    retention
+		now    time.Time
+		names  []string
+		pruned []string
+	}{
+		{
+			// Wednesday, so keeping 2 days is today and yesterday
+			"days",
+			retention{Recent: 1, Daily: 2},
+			at(2026, time.October, 14, 12),
+			[]string{
+				"20261014-110000.tar.gz",
+				"20261014-100000.tar.gz",
+				"20261013-230000.tar.gz",
+				"20261013-010000.tar.gz",
+				"20261012-235959.tar.gz",
+			},
+			[]string{"20261012-235959.tar.gz", "20261013-010000.tar.gz", "20261014-100000.tar.gz"},
+		},
+		{
+			// Monday, so keeping 2 weeks is this one (only just started) and the one which ended yesterday
+			"weeks",
+			retention{Recent: 1, Weekly: 2},
+			at(2026, time.October, 12, 9),
+			[]string{
+				"20261012-080000.tar.gz",
+				"20261011-230000.tar.gz",
+				"20261010-120000.tar.gz",
+				"20261004-230000.tar.gz",
+			},
+			[]string{"20261004-230000.tar.gz", "20261010-120000.tar.gz"},
+		},
+		{
+			// the 1st of January 2027 is still in the last ISO week of 2026
+			"weeks across a year",
+			retention{Recent: 1, Weekly: 2},
+			at(2027, time.January, 5, 10),
+			[]string{
+				"20270105-090000.tar.gz",
+				"20270104-090000.tar.gz",
+				"20270101-120000.tar.gz",
+				"20261231-120000.tar.gz",
+				"20261227-120000.tar.gz",
+			},
+			[]string{"20261227-120000.tar.gz", "20261231-120000.tar.gz", "20270104-090000.tar.gz"},
+		},
+		{
+			"recent",
+			retention{Recent: 3},
+			at(2026, time.October, 14, 12),
+			[]string{
+				"20261014-110000.tar.gz",
+				"20261014-104500.tar.gz",
+				"20261014-103000.tar.gz",
+				"20261014-101500.tar.gz",
+				"20261013-110000.db.gz",
+			},
+			[]string{"20261013-110000.db.gz", "20261014-101500.tar.gz"},
+		},
+		{
+			// incremental dumps only go once there's no full dump kept before them, and anything else is left alone
+			"incrementals",
+			retention{Recent: 1, Daily: 1},
+			at(2026, time.October, 14, 12),
+			[]string{
+				"20261014-110000.tar.gz",
+				"20261014-111500.inc.tar.gz",
+				"20261014-103000.inc.tar.gz",
+				"20261013-110000.tar.gz",
+				"20261013-111500.inc.tar.gz",
+				"20261014-120000.tar.gz.tmp",
+				"notes.txt",
+			},
+			[]string{"20261013-110000.tar.gz", "20261013-111500.inc.tar.gz", "20261014-103000.inc.tar.gz"},
+		},
+	}
+
+	for _, test := range tests {
+		pruned := test.ret.prune(test.names, test.now)
+		sort.Strings(pruned)
+		if !reflect.DeepEqual(pruned, test.pruned) {
+			t.Errorf("%s: pruned %v, not %v", test.name, pruned, test.pruned)
+		}
+	}
+}
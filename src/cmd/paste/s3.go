@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/chilts/rod"
+)
+
+// With PASTE_STORAGE=s3 each blob is kept as an object in an S3 compatible bucket instead of dir, gzipped just like a
+// blob file:
+//
+//     <prefix>blobs.sha256/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08.gz
+//
+// The bucket only holds bytes. Which objects are still needed is decided by the blob bucket, so an object is only put
+// while something references its blob and is deleted once the last reference goes. Objects are stored with
+// `Content-Encoding: gzip`, so if PASTE_S3_REDIRECT is set the raw and download routes can send clients which accept
+// gzip straight to the bucket with a presigned URL. When PASTE_DIR still has blob files in it, Open falls back to the
+// bucket for anything not there, and compressEvery uploads them one at a time.
+//
+// Only what is needed is implemented here (signed with AWS Signature Version 4, using path style URLs), which works
+// with AWS itself and the likes of MinIO.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	prefix    string
+	redirect  time.Duration // how long presigned redirects last, or 0 to always stream objects
+	client    *http.Client
+}
+
+// s3UnsignedPayload is signed in place of the payload's hash when it isn't known, as in presigned URLs.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// newS3ClientFromEnv returns an s3Client configured from the environment, or nil if PASTE_STORAGE isn't s3.
+func newS3ClientFromEnv() (*s3Client, error) {
+	if os.Getenv("PASTE_STORAGE") != "s3" {
+		return nil, nil
+	}
+
+	endpoint := os.Getenv("PASTE_S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("Specify the object storage endpoint in 'PASTE_S3_ENDPOINT', " +
+			"e.g. 'https://s3.us-east-1.amazonaws.com'")
+	}
+	bucket := os.Getenv("PASTE_S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("Specify the bucket to keep paste text in with 'PASTE_S3_BUCKET'")
+	}
+	accessKey := os.Getenv("PASTE_S3_ACCESS_KEY")
+	secretKey := os.Getenv("PASTE_S3_SECRET_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("Specify the bucket's credentials with 'PASTE_S3_ACCESS_KEY' and 'PASTE_S3_SECRET_KEY'")
+	}
+	region, prefix := os.Getenv("PASTE_S3_REGION"), os.Getenv("PASTE_S3_PREFIX")
+	c, err := newS3Client(endpoint, region, bucket, accessKey, secretKey, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if str := os.Getenv("PASTE_S3_REDIRECT"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid 'PASTE_S3_REDIRECT' %q, use how long presigned URLs last such as '5m'", str)
+		}
+		c.redirect = d
+	}
+	return c, nil
+}
+
+// newS3Client returns an s3Client for the bucket at endpoint, with every key starting with prefix. The region defaults
+// to us-east-1, which is what most S3 compatible servers expect.
+func newS3Client(endpoint, region, bucket, accessKey, secretKey, prefix string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid object storage endpoint %q, use a URL such as "+
+			"'https://s3.us-east-1.amazonaws.com'", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3Client{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		prefix:    prefix,
+		// objects are gzipped and must stay that way, so don't let the transport decompress them
+		client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableCompression: true}},
+	}, nil
+}
+
+// blobKey returns the key of the blob with this hash.
+func (c *s3Client) blobKey(hash string) string {
+	return c.prefix + blobDirName + "/" + hash + gzipExt
+}
+
+// url returns the path style URL of the object with this key, or of the bucket itself if key is "".
+func (c *s3Client) url(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+// Put saves the object, replacing whatever was there. Anything in header (such as Content-Type) is saved with it and
+// sent back with it.
+func (c *s3Client) Put(key string, data []byte, header http.Header) error {
+	req, err := http.NewRequest("PUT", c.url(key, nil).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := c.do(req, key, data)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Get returns the object for reading. If it doesn't exist the error satisfies os.IsNotExist.
+func (c *s3Client) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.url(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Exists says whether there is an object with this key.
+func (c *s3Client) Exists(key string) (bool, error) {
+	req, err := http.NewRequest("HEAD", c.url(key, nil).String(), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.do(req, key, nil)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, res.Body.Close()
+}
+
+// Delete removes the object, if it is there.
+func (c *s3Client) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", c.url(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(req, key, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// s3ListResult is the part of a ListObjectsV2 response we need.
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List calls fn with the key and size of every object whose key starts with prefix, in order.
+func (c *s3Client) List(prefix string, fn func(key string, size int64) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest("GET", c.url("", query).String(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.do(req, "", nil)
+		if err != nil {
+			return err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			err := fn(object.Key, object.Size)
+			if err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Presign returns a URL which anyone can GET the object from until it expires. Anything in query (such as
+// response-content-disposition) overrides what is sent back with the object.
+func (c *s3Client) Presign(key string, expires time.Duration, query url.Values) string {
+	now := time.Now().UTC()
+	q := url.Values{}
+	for name, values := range query {
+		q[name] = values
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", c.accessKey+"/"+c.scope(now))
+	q.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	u := c.url(key, q)
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := c.sign("GET", u, header, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// do signs and sends the request, returning the response if it succeeded. Anything else is returned as an error, which
+// satisfies os.IsNotExist if the object (or bucket) doesn't exist.
+func (c *s3Client) do(req *http.Request, key string, payload []byte) (*http.Response, error) {
+	now := time.Now().UTC()
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := s3SignedHeaders(req.Header)
+	signature := c.sign(req.Method, req.URL, req.Header, payloadHash, now)
+	req.Header.Del("Host") // sent from req.Host
+	auth := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, c.scope(now), signedHeaders, signature)
+	req.Header.Set("Authorization", auth)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(req.Method), Path: c.bucket + "/" + key, Err: os.ErrNotExist}
+	}
+	s3Err := struct {
+		Code    string
+		Message string
+	}{}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if xml.Unmarshal(body, &s3Err) != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("%s %s/%s: %s", req.Method, c.bucket, key, res.Status)
+	}
+	return nil, fmt.Errorf("%s %s/%s: %s: %s", req.Method, c.bucket, key, s3Err.Code, s3Err.Message)
+}
+
+const s3TimeFormat = "20060102T150405Z"
+
+// scope is what a signature made at t is good for.
+func (c *s3Client) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+}
+
+// sign returns the Signature Version 4 signature of a request, signing the Host and every X-Amz-* header.
+func (c *s3Client) sign(method string, u *url.URL, header http.Header, payloadHash string, t time.Time) string {
+	names := strings.Split(s3SignedHeaders(header), ";")
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(header.Get(name)) + "\n"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders,
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format(s3TimeFormat),
+		c.scope(t),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{t.Format("20060102"), c.region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// s3SignedHeaders returns the names of the headers which are signed, in order, separated by semicolons.
+func s3SignedHeaders(header http.Header) string {
+	names := make([]string, 0)
+	for name := range header {
+		name = strings.ToLower(name)
+		if name == "host" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query returns the query in its canonical form, sorted by name with everything escaped.
+func s3Query(query url.Values) string {
+	params := make([]string, 0)
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent encodes everything apart from the unreserved characters (and "/" unless escapeSlash), as signing
+// needs.
+func s3Escape(str string, escapeSlash bool) string {
+	buf := bytes.Buffer{}
+	for _, c := range []byte(str) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// RedirectURL returns a presigned URL for the text of this revision of the paste, for clients to fetch it themselves
+// still gzipped, or "" if it isn't in object storage or redirects are off. If filename isn't "" the client is told to
+// save it as that. Only the metadata is read, so the object isn't fetched just to send the client elsewhere.
+func (s *BoltStore) RedirectURL(id string, rev int, filename string) (string, error) {
+	if s.objects == nil || s.objects.redirect == 0 {
+		return "", nil
+	}
+
+	var revision Revision
+	inBolt := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		paste := Paste{}
+		err := rod.GetJson(tx, pasteBucketNameStr, id, &paste)
+		if err != nil || paste.Id == "" {
+			return err
+		}
+		revisions, err := getRevisions(tx, paste)
+		if err != nil {
+			return err
+		}
+		for _, r := range revisions {
+			if r.Rev == rev {
+				revision = r
+			}
+		}
+		inBolt = revision.Hash != "" && hasText(tx, revision.Hash)
+		return nil
+	})
+	if err != nil || revision.Hash == "" || inBolt {
+		return "", err
+	}
+	// blobs still in dir (not moved to object storage yet) are served from there, like Open does
+	blob := blobFilename(s.dir, revision.Hash)
+	if fileExists(blob+gzipExt) || fileExists(blob) {
+		return "", nil
+	}
+
+	query := url.Values{}
+	if filename != "" {
+		query.Set("response-content-disposition", "attachment; filename="+filename)
+	}
+	return s.objects.Presign(s.objects.blobKey(revision.Hash), s.objects.redirect, query), nil
+}
+
+// redirecter is implemented by Stores which can send clients to fetch the text of a paste for themselves.
+type redirecter interface {
+	RedirectURL(id string, rev int, filename string) (string, error)
+}
+
+// redirectText redirects the client to fetch the latest text of the paste for itself, if it can. Since it will get the
+// text exactly as it is stored, that's only if it accepts gzip. It returns false if the text should be sent as usual.
+func redirectText(w http.ResponseWriter, r *http.Request, store Store, paste Paste, filename string) bool {
+	rs, ok := store.(redirecter)
+	if !ok {
+		return false
+	}
+	if !acceptsGzip(r) {
+		return false
+	}
+	u, err := rs.RedirectURL(paste.Id, paste.LatestRevision(), filename)
+	if err != nil {
+		// the text can still be sent as usual
+		log.Printf("Err presigning %s: %s\n", paste.Id, err)
+		return false
+	}
+	if u == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	http.Redirect(w, r, u, http.StatusFound)
+	return true
+}
+
+// putObject saves the gzipped text of a blob in object storage, unless it is already there. It returns true if it was
+// saved. The blob must already be referenced so that it can't be removed once it's there.
+func (s *BoltStore) putObject(hash string, gz []byte) (bool, error) {
+	key := s.objects.blobKey(hash)
+	ok, err := s.objects.Exists(key)
+	if err != nil || ok {
+		return false, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Encoding", "gzip")
+	return true, s.objects.Put(key, gz, header)
+}
+
+// openObject opens the text of a blob kept in object storage. If it isn't there the error satisfies os.IsNotExist.
+func (s *BoltStore) openObject(hash string) (io.ReadCloser, error) {
+	key := s.objects.blobKey(hash)
+	body, err := s.objects.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipFile{f: body}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+const slugMinLen = 3
+const slugMaxLen = 64
+const slugChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+
+// These are the routes in newMux() which a slug would otherwise hide, so keep this in sync with them. "blobs" is the
+// start of blobDirName, which a flat layout paste file would sit next to.
+var reservedSlugs = []string{
+	"about", "paste", "dl", "iframe", "s", "hash", "favicon.ico", "robots.txt", "sitemap.txt", "blobs",
+}
+
+// errSlugTaken is returned from within the transaction which creates a paste if the slug asked for already exists.
+var errSlugTaken = errors.New("slug is already taken")
+
+// checkSlug returns a message for the creator if the slug can't be used, or "" if it is fine. Whether it is already
+// taken is checked later, when the paste is saved.
+func checkSlug(slug string) string {
+	if len(slug) < slugMinLen || len(slug) > slugMaxLen {
+		return "Use between 3 and 64 characters"
+	}
+	for _, c := range slug {
+		if !strings.ContainsRune(slugChars, c) {
+			return "Use only letters, numbers, '-' and '_'"
+		}
+	}
+	if isReserved(slug) {
+		return "This name is reserved"
+	}
+	return ""
+}
+
+// isReserved says whether this Id would be hidden by one of the routes in newMux(). Routes are matched exactly, so
+// "About" is still fine. Both slugs and generated Ids are checked, since a random Id can be "about" as easily as
+// anything else.
+func isReserved(id string) bool {
+	for _, reserved := range reservedSlugs {
+		if id == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// slugIdAllocator "allocates" the slug the creator asked for, as long as it isn't already taken.
+type slugIdAllocator string
+
+func (s slugIdAllocator) Allocate(taken func(id string) bool) (string, error) {
+	if taken(string(s)) {
+		return "", errSlugTaken
+	}
+	return string(s), nil
+}
@@ -0,0 +1,247 @@
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a MetaStore which keeps the paste metadata the handlers look up (each Paste and the public index) in
+// SQLite. Unlike bolt, which locks its file for one process, other processes can read it whilst another writes. The
+// server doesn't use it yet, since revisions, views and blob references are still only kept in bolt, but
+// `paste migrate-sqlite` fills it from paste.db. It is only built with `-tags sqlite`, since
+// github.com/mattn/go-sqlite3 (in vendor/) needs cgo.
+//
+// Each paste is kept as JSON just like in the paste bucket, and the public index is ordered by Id just like the public
+// bucket:
+//
+//     paste  (id TEXT PRIMARY KEY, json TEXT)
+//     public (id TEXT PRIMARY KEY, created TEXT)
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS paste (
+	id   TEXT PRIMARY KEY,
+	json TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS public (
+	id      TEXT PRIMARY KEY,
+	created TEXT NOT NULL
+);
+`
+
+// NewSQLiteStore opens (or creates) the SQLite database in filename, creating the tables if they don't already exist.
+// It uses a write-ahead log, so readers never wait for the writer, and waits up to 5s for other writers.
+func NewSQLiteStore(filename string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Make sure SQLiteStore implements MetaStore.
+var _ MetaStore = &SQLiteStore{}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Put saves the paste, replacing any with the same Id, and adds it to the public index if it is public.
+func (s *SQLiteStore) Put(paste Paste) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	data, err := json.Marshal(paste)
+	if err != nil {
+		return err
+	}
+	err = putSQLitePaste(tx, paste.Id, data)
+	if err != nil {
+		return err
+	}
+	if paste.Visibility == "public" {
+		err = putSQLitePublic(tx, paste.Id, paste.Created.Format("20060201-150405.000000000"))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get returns the paste, or ErrNotFound.
+func (s *SQLiteStore) Get(id string) (Paste, error) {
+	paste := Paste{}
+	var str string
+	err := s.db.QueryRow("SELECT json FROM paste WHERE id = ?", id).Scan(&str)
+	if err == sql.ErrNoRows {
+		return paste, ErrNotFound
+	}
+	if err != nil {
+		return paste, err
+	}
+	err = json.Unmarshal([]byte(str), &paste)
+	return paste, err
+}
+
+// Delete removes the paste and its public key. It returns false if the paste had already gone.
+func (s *SQLiteStore) Delete(id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM paste WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM public WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// ListPublic calls fn with the Id of every public paste, in order.
+func (s *SQLiteStore) ListPublic(fn func(id string) error) error {
+	rows, err := s.db.Query("SELECT id FROM public ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		err = fn(id)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func putSQLitePaste(tx *sql.Tx, id string, data []byte) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO paste (id, json) VALUES (?, ?)", id, string(data))
+	return err
+}
+
+func putSQLitePublic(tx *sql.Tx, id, created string) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO public (id, created) VALUES (?, ?)", id, created)
+	return err
+}
+
+// migrateSQLiteCmd is the `paste migrate-sqlite` command, which copies the paste and public buckets from paste.db into
+// SQLite, exactly as they are, in one transaction. An existing SQLite database with pastes in it is only overwritten
+// with -force. It needs paste.db to itself, so the server must be stopped.
+func migrateSQLiteCmd(args []string) error {
+	flags := flag.NewFlagSet("migrate-sqlite", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace everything already in the SQLite database")
+	dbFilename := flags.String("db", "paste.db", "the datastore to copy from")
+	out := flags.String("o", "paste.sqlite", "the SQLite database to copy to")
+	flags.Parse(args)
+
+	db, err := bolt.Open(*dbFilename, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening %s (is the server still running?): %s", *dbFilename, err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLiteStore(*out)
+	if err != nil {
+		return fmt.Errorf("opening %s: %s", *out, err)
+	}
+	defer store.Close()
+
+	existing := 0
+	err = store.db.QueryRow("SELECT COUNT(*) FROM paste").Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing > 0 && !*force {
+		return fmt.Errorf("%s already has %d pastes, use -force to replace them", *out, existing)
+	}
+
+	pastes, public, err := store.copyFrom(db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d pastes (%d public) from %s to %s\n", pastes, public, *dbFilename, *out)
+	return nil
+}
+
+// copyFrom replaces everything with the paste and public buckets from db, exactly as they are, in one transaction. It
+// returns how many pastes and public keys were copied.
+func (s *SQLiteStore) copyFrom(db *bolt.DB) (int, int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"paste", "public"} {
+		_, err := tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	pastes, public := 0, 0
+	err = db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(pasteBucketName)
+		if b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				// make sure it decodes, but copy it exactly as it is
+				paste := Paste{}
+				err := json.Unmarshal(v, &paste)
+				if err != nil {
+					return fmt.Errorf("paste %s: %s", k, err)
+				}
+				pastes++
+				return putSQLitePaste(tx, string(k), v)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b = btx.Bucket(publicBucketName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			public++
+			return putSQLitePublic(tx, string(k), string(v))
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return pastes, public, tx.Commit()
+}
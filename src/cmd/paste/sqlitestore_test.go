@@ -0,0 +1,111 @@
+// +build sqlite
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listPublic(t *testing.T, store MetaStore) []string {
+	public := make([]string, 0)
+	err := store.ListPublic(func(id string) error {
+		public = append(public, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListPublic() returned an error: %s", err)
+	}
+	return public
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paste-sqlite-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewSQLiteStore(filepath.Join(dir, "paste.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() returned an error: %s", err)
+	}
+	defer store.Close()
+
+	now := time.Now().UTC()
+	for _, paste := range []Paste{
+		{Id: "b", Visibility: "public", Size: 5, Revision: 1, Created: now, Updated: now},
+		{Id: "a", Visibility: "public", Size: 5, Revision: 1, Created: now, Updated: now},
+		{Id: "c", Visibility: "unlisted", Size: 5, Revision: 1, Created: now, Updated: now},
+	} {
+		err := store.Put(paste)
+		if err != nil {
+			t.Fatalf("Put() returned an error: %s", err)
+		}
+	}
+
+	paste, err := store.Get("c")
+	if err != nil || paste.Id != "c" || !paste.Created.Equal(now) {
+		t.Fatalf("Get(c) returned %+v, %v", paste, err)
+	}
+	if public := listPublic(t, store); len(public) != 2 || public[0] != "a" || public[1] != "b" {
+		t.Fatalf("ListPublic() returned %v, not [a b]", public)
+	}
+
+	deleted, err := store.Delete("a")
+	if err != nil || !deleted {
+		t.Fatalf("Delete(a) returned %v, %v", deleted, err)
+	}
+	deleted, err = store.Delete("a")
+	if err != nil || deleted {
+		t.Fatalf("Delete(a) again returned %v, %v", deleted, err)
+	}
+	if _, err := store.Get("a"); err != ErrNotFound {
+		t.Fatalf("Get(a) after Delete() returned %v, not ErrNotFound", err)
+	}
+	if public := listPublic(t, store); len(public) != 1 || public[0] != "b" {
+		t.Fatalf("ListPublic() after Delete() returned %v, not [b]", public)
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	bs, _ := newBoltStore(t)
+	public := createPasteAt(t, bs, "hello", time.Now().UTC())
+	unlisted := createPaste(t, bs, "world")
+	dbFilename := bs.db.Path()
+	bs.db.Close()
+
+	out := filepath.Join(filepath.Dir(dbFilename), "paste.sqlite")
+	err := migrateSQLiteCmd([]string{"-db", dbFilename, "-o", out})
+	if err != nil {
+		t.Fatalf("migrateSQLiteCmd() returned an error: %s", err)
+	}
+
+	// and won't overwrite it without -force
+	err = migrateSQLiteCmd([]string{"-db", dbFilename, "-o", out})
+	if err == nil {
+		t.Fatalf("migrateSQLiteCmd() replaced the pastes already there")
+	}
+	err = migrateSQLiteCmd([]string{"-force", "-db", dbFilename, "-o", out})
+	if err != nil {
+		t.Fatalf("migrateSQLiteCmd() with -force returned an error: %s", err)
+	}
+
+	store, err := NewSQLiteStore(out)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore() returned an error: %s", err)
+	}
+	defer store.Close()
+	for _, want := range []Paste{public, unlisted} {
+		got, err := store.Get(want.Id)
+		if err != nil || got.Id != want.Id || got.Visibility != want.Visibility || !got.Created.Equal(want.Created) {
+			t.Errorf("Get(%s) returned %+v, %v, want %+v", want.Id, got, err, want)
+		}
+	}
+	if ids := listPublic(t, store); len(ids) != 1 || ids[0] != public.Id {
+		t.Errorf("ListPublic() returned %v, not [%s]", ids, public.Id)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned from a Store if the paste (or revision) asked for doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned from Import if a paste with the same Id already exists.
+var ErrExists = errors.New("already exists")
+
+// Store keeps the metadata and text of every paste. The handlers only ever use a Store, so it is the only thing which
+// knows where pastes actually live.
+type Store interface {
+	// Create saves a new paste with the text as its first revision. The Id is allocated within the same transaction
+	// which saves the paste, and the paste is returned with it set.
+	Create(paste Paste, text []byte, ids IdAllocator) (Paste, error)
+
+	// Get returns the paste, or ErrNotFound.
+	Get(id string) (Paste, error)
+
+	// Open returns a reader for the text of this revision of the paste, or ErrNotFound. Anything already opened can
+	// still be read even if the paste is deleted in the meantime.
+	Open(id string, rev int) (io.ReadCloser, error)
+
+	// Revisions returns every revision of the paste in order, or ErrNotFound.
+	Revisions(id string) ([]Revision, error)
+
+	// Revise saves the text as a new revision of the paste, leaving all previous revisions untouched, and returns the
+	// updated paste.
+	Revise(id, title string, text []byte) (Paste, error)
+
+	// View counts a view of a paste with a view limit, checking and incrementing the count atomically. It returns
+	// false if the limit has already been reached (or the paste has gone) and the paste should not be served.
+	View(id string) (bool, error)
+
+	// Delete removes everything about the paste. It returns false if the paste had already gone, which means someone
+	// else deleted it first.
+	Delete(id string) (bool, error)
+
+	// ListPublic calls fn with the Id of every public paste.
+	ListPublic(fn func(id string) error) error
+
+	// Iterate calls fn with every paste. The Store should not be modified from within fn.
+	Iterate(fn func(paste Paste) error) error
+
+	// Import saves a paste exactly as given, keeping its Id, timestamps and every revision (texts[i] being the text of
+	// revisions[i]). It returns ErrExists if the Id is already in use.
+	Import(paste Paste, revisions []Revision, texts [][]byte) error
+
+	// PublicExists says whether any revision of a public paste has the text with this hash (from hashText). Unlisted
+	// and encrypted pastes are left out, so that nobody can check whether someone else pasted a text they can guess.
+	PublicExists(hash string) (bool, error)
+}
+
+// MetaStore keeps just the Paste of each paste and the public index, which is all most requests need before the text
+// itself. See SQLiteStore.
+type MetaStore interface {
+	// Get returns the paste, or ErrNotFound.
+	Get(id string) (Paste, error)
+
+	// Put saves the paste, replacing any with the same Id, and adds it to the public index if it is public.
+	Put(paste Paste) error
+
+	// Delete removes the paste and its public key. It returns false if the paste had already gone.
+	Delete(id string) (bool, error)
+
+	// ListPublic calls fn with the Id of every public paste, in order.
+	ListPublic(fn func(id string) error) error
+
+	Close() error
+}
+
+// checkImport makes sure a paste being imported is complete, with every revision from 1 up to its latest.
+func checkImport(paste Paste, revisions []Revision, texts [][]byte) error {
+	if paste.Id == "" {
+		return errors.New("paste has no Id")
+	}
+	if len(revisions) == 0 || len(revisions) != len(texts) {
+		return errors.New("paste needs a text for every revision")
+	}
+	for i, revision := range revisions {
+		if revision.Rev != i+1 {
+			return fmt.Errorf("revision %d is missing", i+1)
+		}
+	}
+	if revisions[len(revisions)-1].Rev != paste.LatestRevision() {
+		return fmt.Errorf("latest revision is %d, not %d", revisions[len(revisions)-1].Rev, paste.LatestRevision())
+	}
+	return nil
+}
@@ -8,6 +8,40 @@ type Paste struct {
 	Size       int
 	Visibility string // public, unlisted, encrypted
 	Expire     time.Time
+	Burn       bool   // removed once it has been read
+	MaxViews   int    // 0 for no limit, views so far are kept in the views bucket
+	DeleteHash string // hash of the delete token given to the creator
+	EditHash   string // hash of the edit token given to the creator
+	Revision   int    // the latest revision, 0 for pastes created before revisions existed
 	Created    time.Time
-	Updated    time.Time
+	Updated    time.Time // when the latest revision was created
+}
+
+// Revision is one immutable version of the text of a paste.
+type Revision struct {
+	Rev     int
+	Size    int
+	Created time.Time
+	Hash    string // the SHA-256 of the text, which names its blob (empty for revisions from before blobs)
+}
+
+// HasExpired returns true if this paste has an expiry time set and it is before now.
+func (p Paste) HasExpired(now time.Time) bool {
+	if p.Expire.IsZero() {
+		return false
+	}
+	return now.After(p.Expire)
+}
+
+// Previous returns the number of the revision before this one, or 0 if this is the first.
+func (r Revision) Previous() int {
+	return r.Rev - 1
+}
+
+// LatestRevision returns the number of the latest revision. Pastes created before revisions existed only have the one.
+func (p Paste) LatestRevision() int {
+	if p.Revision < 1 {
+		return 1
+	}
+	return p.Revision
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// verifyDumpCmd is the `paste verify-dump <file>` command.
+func verifyDumpCmd(args []string) error {
+	flags := flag.NewFlagSet("verify-dump", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: paste verify-dump <file>")
+	}
+	filename := flags.Arg(0)
+
+	pastes, files, err := verifyDump(filename, func(problem string) {
+		fmt.Println(problem)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	if isIncrementalDump(filename) {
+		fmt.Printf("%s is OK, with %d changes and %d paste files\n", filename, pastes, files)
+	} else {
+		fmt.Printf("%s is OK, with %d pastes and %d paste files\n", filename, pastes, files)
+	}
+	return nil
+}
+
+// verifyText checks that the text of a revision kept in the DB decompresses to the right size and hash.
+func verifyText(tx *bolt.Tx, revision Revision) error {
+	gz, err := getText(tx, revision.Hash)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, newTextReader(gz))
+	if err != nil {
+		return fmt.Errorf("doesn't decompress: %s", err)
+	}
+	if n != int64(revision.Size) {
+		return fmt.Errorf("is %d bytes, not %d", n, revision.Size)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != revision.Hash {
+		return errors.New("doesn't match its hash")
+	}
+	return nil
+}
+
+// verifyDump checks everything it can about a dump. Every checksum must match the MANIFEST, the DB snapshot must open,
+// everything in the paste and public buckets must decode and refer to a paste, and every revision must have its file
+// in the dump (or its text in the DB, and apart from those dumpsText leaves out), with the right size and hash. For an
+// incremental dump each change must decode and every file must be listed.
+//
+// Each problem is passed to report, and an error is returned if there were any. It returns how many pastes (or
+// changes) and paste files were in the dump.
+func verifyDump(filename string, report func(problem string)) (int, int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	// the bolt snapshot needs to be a file to be opened
+	tmp, err := ioutil.TempFile("", "paste-verify-")
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	sizes := make(map[string]int64)
+	hashes := make(map[string]string)
+	changes := make([]dumpChange, 0)
+	haveDb, haveChanges := false, false
+
+	if strings.HasSuffix(filename, ".db.gz") {
+		// old style dumps are just the DB, so that's all there is to check
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = writeFileFrom(tmp.Name(), zr)
+		if err != nil {
+			return 0, 0, err
+		}
+		haveDb = true
+	} else {
+		err = readDump(f, func(name string, r io.Reader) error {
+			switch name {
+			case dumpDbName:
+				haveDb = true
+				return writeFileFrom(tmp.Name(), r)
+			case dumpChangesName:
+				haveChanges = true
+				dec := json.NewDecoder(r)
+				for {
+					change := dumpChange{}
+					err := dec.Decode(&change)
+					if err == io.EOF {
+						return nil
+					}
+					if err != nil {
+						return fmt.Errorf("%s: %s", dumpChangesName, err)
+					}
+					changes = append(changes, change)
+				}
+			default:
+				h := sha256.New()
+				n, err := io.Copy(h, r)
+				sizes[filepath.Base(name)] = n
+				hashes[filepath.Base(name)] = hex.EncodeToString(h.Sum(nil))
+				return err
+			}
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	problems := 0
+	problem := func(format string, a ...interface{}) {
+		problems++
+		report(fmt.Sprintf(format, a...))
+	}
+
+	if haveChanges {
+		// an incremental dump, which only has the files of new revisions
+		for _, change := range changes {
+			if change.Paste == nil && change.Tombstone == nil {
+				problem("change with no paste or tombstone")
+			}
+			if change.Paste == nil {
+				continue
+			}
+			for _, revision := range change.Revisions {
+				hash, ok := hashes[pasteBasename(change.Paste.Id, revision.Rev)]
+				if ok && revision.Hash != "" && hash != revision.Hash {
+					problem("revision %d of %s doesn't match its hash", revision.Rev, change.Paste.Id)
+				}
+			}
+		}
+		if haveDb {
+			problem("incremental dump also has a %s", dumpDbName)
+		}
+		if problems > 0 {
+			return len(changes), len(sizes), fmt.Errorf("%d problem(s) found", problems)
+		}
+		return len(changes), len(sizes), nil
+	}
+	if !haveDb {
+		return 0, 0, fmt.Errorf("no %s in dump", dumpDbName)
+	}
+
+	db, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %s", dumpDbName, err)
+	}
+	defer db.Close()
+
+	pastes := make(map[string]bool)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pasteBucketName)
+		if b == nil {
+			problem("no %s bucket", pasteBucketNameStr)
+			return nil
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			paste := Paste{}
+			err := json.Unmarshal(v, &paste)
+			if err != nil {
+				problem("paste %s doesn't decode: %s", k, err)
+				return nil
+			}
+			if paste.Id != string(k) {
+				problem("paste %s has the Id %s", k, paste.Id)
+			}
+			pastes[string(k)] = true
+
+			revisions, err := getRevisions(tx, paste)
+			if err != nil {
+				problem("revisions of %s don't decode: %s", k, err)
+				return nil
+			}
+			if strings.HasSuffix(filename, ".db.gz") {
+				return nil
+			}
+			for _, revision := range revisions {
+				name := pasteBasename(paste.Id, revision.Rev)
+				if revision.Hash != "" && hasText(tx, revision.Hash) {
+					// kept in the DB rather than as a file
+					err := verifyText(tx, revision)
+					if err != nil {
+						problem("revision %d of %s %s", revision.Rev, k, err)
+					}
+					continue
+				}
+				size, ok := sizes[name]
+				if !ok && !dumpsText(paste) {
+					continue
+				}
+				if !ok {
+					problem("revision %d of %s has no file in the dump", revision.Rev, k)
+					continue
+				}
+				if size != int64(revision.Size) {
+					problem("revision %d of %s is %d bytes, not %d", revision.Rev, k, size, revision.Size)
+				}
+				if revision.Hash != "" && hashes[name] != revision.Hash {
+					problem("revision %d of %s doesn't match its hash", revision.Rev, k)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		b = tx.Bucket(publicBucketName)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if !pastes[string(k)] {
+				problem("public key %s has no paste", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if problems > 0 {
+		return len(pastes), len(sizes), fmt.Errorf("%d problem(s) found", problems)
+	}
+	return len(pastes), len(sizes), nil
+}
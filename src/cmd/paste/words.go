@@ -0,0 +1,29 @@
+package main
+
+// idWords are the words used for word based Ids. There are 256 of them so that each word is picked with a single
+// random byte. They are all lowercase, distinct, and easy to say out loud.
+var idWords = []string{
+	"acorn", "actor", "agent", "alarm", "album", "alpha", "amber", "angle", "apple", "apron", "arena", "arrow",
+	"atlas", "autumn", "badge", "baker", "bamboo", "banjo", "barrel", "basil", "basket", "beach", "beacon", "bean",
+	"bear", "beaver", "bell", "berry", "bison", "blade", "blanket", "bloom", "board", "boat", "bonus", "boot",
+	"bottle", "brave", "bread", "brick", "bridge", "brook", "brush", "bucket", "bugle", "cabin", "cactus", "camel",
+	"candle", "canoe", "canyon", "carbon", "carrot", "castle", "cedar", "cello", "chalk", "cherry", "chess", "chief",
+	"cider", "cinema", "circle", "citrus", "clay", "cliff", "clock", "cloud", "clover", "coast", "cobalt", "cocoa",
+	"comet", "coral", "cotton", "cousin", "cradle", "crane", "crayon", "creek", "cricket", "crystal", "cupboard",
+	"daisy", "dancer", "delta", "desert", "diamond", "dinner", "dolphin", "donkey", "dragon", "dream", "drum",
+	"eagle", "echo", "elbow", "ember", "engine", "falcon", "feather", "fern", "fiddle", "field", "finch", "flag",
+	"flame", "flute", "forest", "fossil", "fox", "frost", "garden", "garlic", "gecko", "giant", "ginger", "glacier",
+	"globe", "goose", "grape", "gravel", "guitar", "hammer", "harbor", "hazel", "helmet", "heron", "hill", "honey",
+	"horizon", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jungle", "kettle", "kite", "koala",
+	"ladder", "lagoon", "lantern", "lemon", "lily", "lion", "lizard", "llama", "lobster", "locket", "lotus", "magnet",
+	"mango", "maple", "marble", "meadow", "melon", "mirror", "monkey", "moose", "mountain", "nectar", "needle",
+	"nutmeg", "oak", "ocean", "olive", "onion", "orbit", "orchid", "otter", "owl", "paddle", "panda", "panther",
+	"paper", "parrot", "peach", "pebble", "pencil", "pepper", "piano", "pigeon", "pillow", "pine", "planet", "plum",
+	"pocket", "pony", "poppy", "potato", "pretzel", "puzzle", "quartz", "quill", "rabbit", "radish", "rainbow",
+	"raven", "ribbon", "river", "robin", "rocket", "rose", "ruby", "saddle", "salmon", "sandal", "saturn", "scarf",
+	"shadow", "shell", "silver", "sparrow", "spider", "spruce", "squash", "star", "stone", "sugar", "summit",
+	"sunset", "swan", "tango", "teapot", "thistle", "thunder", "tiger", "timber", "tomato", "topaz", "tractor",
+	"trumpet", "tulip", "tunnel", "turtle", "umbrella", "valley", "velvet", "violet", "violin", "walnut", "walrus",
+	"willow", "window", "winter", "wizard", "wolf", "yacht", "zebra", "zephyr", "badger", "bagel", "beetle",
+	"biscuit",
+}